@@ -0,0 +1 @@
+alter table connection drop column show_stock
\ No newline at end of file
@@ -0,0 +1 @@
+alter table connection add column show_stock boolean default false;
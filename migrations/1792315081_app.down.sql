@@ -0,0 +1 @@
+alter table connection drop column price_types
\ No newline at end of file
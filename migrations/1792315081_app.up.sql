@@ -0,0 +1 @@
+alter table connection add column price_types jsonb;
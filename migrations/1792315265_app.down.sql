@@ -0,0 +1 @@
+alter table connection drop column sites
\ No newline at end of file
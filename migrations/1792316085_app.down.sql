@@ -0,0 +1 @@
+update connection set commands = commands - '/help' where commands is not null
\ No newline at end of file
@@ -0,0 +1 @@
+update connection set commands = commands || '["/help"]'::jsonb where commands is not null and not commands @> '["/help"]'::jsonb;
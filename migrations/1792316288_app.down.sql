@@ -0,0 +1 @@
+alter table connection drop column answers
\ No newline at end of file
@@ -0,0 +1 @@
+alter table connection drop column events
\ No newline at end of file
@@ -0,0 +1 @@
+alter table connection add column events jsonb;
@@ -0,0 +1 @@
+alter table connection drop column replies
\ No newline at end of file
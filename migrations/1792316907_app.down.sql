@@ -0,0 +1 @@
+update connection set currency = 'byr' where currency = 'byn'
\ No newline at end of file
@@ -0,0 +1 @@
+update connection set currency = 'byn' where currency = 'byr';
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func adminWorkersHandler(c *gin.Context) {
+	workers := wm.listWorkers()
+
+	res := make([]WorkerInfo, len(workers))
+	for k, w := range workers {
+		res[k] = w.Info()
+	}
+
+	c.JSON(http.StatusOK, gin.H{"workers": res})
+}
+
+func adminWorkerHandler(c *gin.Context) {
+	w, ok := wm.getWorker(c.Param("uid"))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Worker not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, w.Info())
+}
+
+func adminRestartWorkerHandler(c *gin.Context) {
+	w, ok := wm.restartWorker(c.Param("uid"))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Worker not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, w.Info())
+}
+
+func adminStopWorkerHandler(c *gin.Context) {
+	w, ok := wm.getWorker(c.Param("uid"))
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Worker not found"})
+		return
+	}
+
+	wm.stopWorker(w.getConnection())
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
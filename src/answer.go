@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	v1 "github.com/retailcrm/mg-bot-api-client-go/v1"
+)
+
+// autoAnswers are connection rules answering plain text messages of customers
+type autoAnswers struct {
+	Rules []autoAnswerRule `json:"rules"`
+	// UnassignedOnly disables answers in chats with an operator assigned to the dialog
+	UnassignedOnly bool `json:"unassigned_only"`
+}
+
+// autoAnswerRule answers messages containing one of comma separated keywords
+// or matching the regular expression. The reply is a text/template template,
+// a reply starting with a slash is run as a bot command
+type autoAnswerRule struct {
+	Keywords string `json:"keywords"`
+	Regexp   bool   `json:"regexp"`
+	Reply    string `json:"reply"`
+}
+
+// autoAnswerCommands are commands auto answers may run, auto answers are sent
+// to whoever writes the keywords so commands showing orders are not allowed
+var autoAnswerCommands = map[string]bool{
+	CommandPayment:  true,
+	CommandDelivery: true,
+	CommandProduct:  true,
+	CommandHelp:     true,
+}
+
+// autoAnswer is a compiled auto answer rule
+type autoAnswer struct {
+	keywords []string
+	regexp   *regexp.Regexp
+	command  bool
+	reply    *template.Template
+}
+
+// autoAnswerData is passed to reply templates
+type autoAnswerData struct {
+	// Text is the customer message
+	Text string
+	// Name is the customer name
+	Name string
+	// Match is the matched keyword or the regular expression match with its groups
+	Match []string
+}
+
+// compile validates the rule and prepares it for matching
+func (r autoAnswerRule) compile() (*autoAnswer, error) {
+	if strings.TrimSpace(r.Keywords) == "" {
+		return nil, errors.New("empty keywords")
+	}
+
+	reply := strings.TrimSpace(r.Reply)
+	if reply == "" {
+		return nil, fmt.Errorf("%s: empty reply", r.Keywords)
+	}
+
+	a := &autoAnswer{}
+
+	if r.Regexp {
+		re, err := regexp.Compile("(?i)" + r.Keywords)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", r.Keywords, err)
+		}
+		a.regexp = re
+	} else {
+		for _, v := range strings.Split(r.Keywords, ",") {
+			if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+				a.keywords = append(a.keywords, v)
+			}
+		}
+	}
+
+	if strings.HasPrefix(reply, "/") {
+		cmd, line := botCommands.parse(reply)
+		if cmd == nil {
+			return nil, fmt.Errorf("%s: unknown command %s", r.Keywords, line.Name)
+		}
+		if !autoAnswerCommands[cmd.Name()] {
+			return nil, fmt.Errorf("%s: command %s is not allowed", r.Keywords, line.Name)
+		}
+		a.command = true
+	}
+
+	tmpl, err := template.New("answer").Funcs(limitedFuncs).Option("missingkey=zero").Parse(r.Reply)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", r.Keywords, err)
+	}
+	a.reply = tmpl
+
+	return a, nil
+}
+
+// match returns the matched keyword or the regular expression submatches, nil means no match
+func (a *autoAnswer) match(text string) []string {
+	if a.regexp != nil {
+		return a.regexp.FindStringSubmatch(text)
+	}
+
+	lower := strings.ToLower(text)
+	for _, v := range a.keywords {
+		if strings.Contains(lower, v) {
+			return []string{v}
+		}
+	}
+
+	return nil
+}
+
+// compileAutoAnswers compiles all rules, the first invalid rule fails the whole set
+func compileAutoAnswers(rules []autoAnswerRule) ([]*autoAnswer, error) {
+	res := make([]*autoAnswer, 0, len(rules))
+	for _, v := range rules {
+		a, err := v.compile()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, a)
+	}
+
+	return res, nil
+}
+
+// matchAutoAnswer returns the first rule matching the text with its match
+func matchAutoAnswer(answers []*autoAnswer, text string) (*autoAnswer, []string) {
+	for _, a := range answers {
+		if m := a.match(text); m != nil {
+			return a, m
+		}
+	}
+
+	return nil, nil
+}
+
+// isAutoAnswerMessage checks the message is a customer text message auto answers apply to
+func isAutoAnswerMessage(message *v1.Message) bool {
+	return message.Type == v1.MsgTypeText &&
+		message.TextMessage != nil &&
+		message.From != nil &&
+		message.From.Type == "customer"
+}
+
+// replyAutoAnswer answers the customer message with the first matching rule,
+// unlike command replies auto answers are sent to the customer
+func (w *Worker) replyAutoAnswer(message *v1.Message) {
+	answer, match := matchAutoAnswer(w.getAnswers(), message.Content)
+	if answer == nil {
+		return
+	}
+
+	if w.getConnection().getAutoAnswers().UnassignedOnly {
+		assigned, err := w.chatAssigned(message.ChatID)
+		if err != nil {
+			w.logger.Warningf("%s - Cannot retrieve dialogs of chat %d, error: %v", w.getConnection().APIURL, message.ChatID, err)
+			return
+		}
+
+		if assigned {
+			autoAnswersTotal.WithLabelValues("assigned").Inc()
+			return
+		}
+	}
+
+	var (
+		msg     string
+		msgProd v1.MessageProduct
+		err     error
+		loc     = w.chatLocalizer(message)
+	)
+
+	msg, err = executeTemplate(answer.reply, autoAnswerData{
+		Text:  message.Content,
+		Name:  message.From.Name,
+		Match: match,
+	})
+	if err != nil {
+		autoAnswersTotal.WithLabelValues("error").Inc()
+		w.logger.Warningf("%s - Cannot execute auto answer template, error: %v", w.getConnection().APIURL, err)
+		return
+	}
+
+	if answer.command {
+		msg = strings.TrimSpace(msg)
+		cmd, _ := botCommands.parse(msg)
+		if cmd == nil || !autoAnswerCommands[cmd.Name()] {
+			autoAnswersTotal.WithLabelValues("error").Inc()
+			w.logger.Warningf("%s - Auto answer command is not allowed: %s", w.getConnection().APIURL, msg)
+			return
+		}
+
+		// answers are public, so disabled commands and errors are not shown to customers
+		if !w.getConnection().isCommandEnabled(cmd.Name()) {
+			autoAnswersTotal.WithLabelValues("disabled").Inc()
+			return
+		}
+
+		msg, msgProd, err = w.execCommand(loc, message.ChatID, msg)
+		if err != nil {
+			autoAnswersTotal.WithLabelValues("error").Inc()
+			w.sendSentry(err)
+			return
+		}
+	}
+
+	autoAnswersTotal.WithLabelValues("sent").Inc()
+	w.sendReply(loc, message.ChatID, v1.MessageScopePublic, msg, msgProd)
+}
+
+// chatAssigned checks an operator is assigned to the active dialog of the chat,
+// the state known from dialog events is used when there is one
+func (w *Worker) chatAssigned(chatID uint64) (bool, error) {
+	if d, ok := w.getChatDialog(chatID); ok {
+		return d.Assigned, nil
+	}
+
+	dialogs, _, err := w.getMGClient().Dialogs(v1.DialogsRequest{
+		ChatID: fmt.Sprint(chatID),
+		Active: 1,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	assigned := false
+	for _, v := range dialogs {
+		if v.IsAssigned && isOperatorResponsible(&v.Responsible) {
+			assigned = true
+			break
+		}
+	}
+
+	w.setChatDialog(chatID, func(d *chatDialog) {
+		d.Assigned = assigned
+	})
+
+	return assigned, nil
+}
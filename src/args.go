@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// commandLine is a command message split into the command name, arguments and flags
+type commandLine struct {
+	// Name is the lower-cased command with the leading slash and without the bot mention
+	Name  string
+	Args  []string
+	Flags map[string]string
+}
+
+// parseCommandLine splits the message into the command and its arguments.
+// Arguments are separated by any whitespace, double or single quotes at the start
+// of an argument group words into one argument and a backslash escapes
+// the next character inside double quotes.
+// Arguments like --key=value are flags, a flag without a value is "true",
+// everything after a bare -- is passed as arguments.
+// A message not starting with a slash has an empty name
+func parseCommandLine(text string) commandLine {
+	res := commandLine{Flags: map[string]string{}}
+
+	tokens := splitArgs(text)
+	if len(tokens) == 0 || !strings.HasPrefix(tokens[0].value, "/") || tokens[0].quoted {
+		return res
+	}
+
+	res.Name = strings.ToLower(tokens[0].value)
+	if i := strings.Index(res.Name, "@"); i != -1 {
+		res.Name = res.Name[:i]
+	}
+
+	flags := true
+	for _, t := range tokens[1:] {
+		switch {
+		case !flags || t.quoted || !strings.HasPrefix(t.value, "--"):
+			res.Args = append(res.Args, t.value)
+		case t.value == "--":
+			flags = false
+		default:
+			kv := strings.SplitN(t.value[2:], "=", 2)
+			if len(kv) == 1 {
+				res.Flags[strings.ToLower(kv[0])] = "true"
+			} else {
+				res.Flags[strings.ToLower(kv[0])] = kv[1]
+			}
+		}
+	}
+
+	return res
+}
+
+type argToken struct {
+	value  string
+	quoted bool
+}
+
+// splitArgs splits text into whitespace separated tokens honoring quotes,
+// a quote opens at the start of a token or after the = of a flag,
+// an unterminated quote takes the rest of the text
+func splitArgs(text string) []argToken {
+	var (
+		res     []argToken
+		cur     []rune
+		quote   rune
+		quoted  bool
+		escaped bool
+		inToken bool
+	)
+
+	flush := func() {
+		if inToken {
+			res = append(res, argToken{value: string(cur), quoted: quoted})
+		}
+		cur, quoted, inToken = nil, false, false
+	}
+
+	for _, r := range text {
+		switch {
+		case escaped:
+			cur = append(cur, r)
+			escaped = false
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0:
+			cur = append(cur, r)
+		case (r == '"' || r == '\'') && !inToken:
+			quote, quoted, inToken = r, true, true
+		case (r == '"' || r == '\'') && isFlagName(cur):
+			quote = r
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			cur = append(cur, r)
+			inToken = true
+		}
+	}
+	flush()
+
+	return res
+}
+
+// isFlagName checks the token so far is a flag name followed by =
+func isFlagName(token []rune) bool {
+	s := string(token)
+	return strings.HasPrefix(s, "--") && strings.HasSuffix(s, "=") && strings.Count(s, "=") == 1
+}
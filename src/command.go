@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	v1 "github.com/retailcrm/mg-bot-api-client-go/v1"
+	"golang.org/x/text/language"
+)
+
+const (
+	CommandPayment  = "/payment"
+	CommandDelivery = "/delivery"
+	CommandProduct  = "/product"
+	CommandOrder    = "/order"
+	CommandHelp     = "/help"
+)
+
+// baseCredentials are CRM credentials the bot needs regardless of commands
+var baseCredentials = []string{
+	"/api/integration-modules/{code}",
+	"/api/integration-modules/{code}/edit",
+	"/api/reference/sites",
+}
+
+// optionalCredentials are CRM credentials of features shown only when they are granted,
+// without them product replies have no stock by stores and no price type names
+var optionalCredentials = []string{
+	"/api/store/inventories",
+	"/api/reference/stores",
+	"/api/reference/price-types",
+}
+
+// botCommands are commands the bot supports, in the order they are shown to users
+var botCommands = newCommandRegistry(
+	paymentCommand{},
+	deliveryCommand{},
+	productCommand{},
+	orderCommand{},
+	helpCommand{},
+).withAliases(commandAliases)
+
+// commandAliases are localized command names by languages,
+// aliases are accepted whatever the chat language is
+var commandAliases = map[language.Tag]map[string]string{
+	language.Russian: {
+		"/оплата":   CommandPayment,
+		"/доставка": CommandDelivery,
+		"/товар":    CommandProduct,
+		"/заказ":    CommandOrder,
+		"/помощь":   CommandHelp,
+	},
+	language.Spanish: {
+		"/pago":     CommandPayment,
+		"/envio":    CommandDelivery,
+		"/envío":    CommandDelivery,
+		"/producto": CommandProduct,
+		"/pedido":   CommandOrder,
+		"/ayuda":    CommandHelp,
+	},
+}
+
+// Command is a bot command, to add a command implement it and register it in botCommands
+type Command interface {
+	// Name returns the command with the leading slash
+	Name() string
+	// Description returns the message ID of the command description
+	Description() string
+	// Usage returns the message ID of the detailed command usage
+	Usage() string
+	// Credentials returns CRM credentials the command needs
+	Credentials() []string
+	// Handle returns the reply to the command
+	Handle(w *Worker, req commandRequest) (string, v1.MessageProduct, error)
+}
+
+// commandRequest is a command received from a chat,
+// Arg is the arguments joined by spaces
+type commandRequest struct {
+	Localizer *i18n.Localizer
+	ChatID    uint64
+	Arg       string
+	Args      []string
+	Flags     map[string]string
+}
+
+// commandRegistry keeps commands by names preserving the registration order
+type commandRegistry struct {
+	commands []Command
+	byName   map[string]Command
+	aliases  map[string]string
+}
+
+func newCommandRegistry(commands ...Command) *commandRegistry {
+	r := &commandRegistry{byName: map[string]Command{}, aliases: map[string]string{}}
+	for _, cmd := range commands {
+		r.register(cmd)
+	}
+
+	return r
+}
+
+// register adds the command, registering the same name twice is a programming error
+func (r *commandRegistry) register(cmd Command) {
+	if _, ok := r.byName[cmd.Name()]; ok {
+		panic(fmt.Sprintf("command %s is already registered", cmd.Name()))
+	}
+
+	r.commands = append(r.commands, cmd)
+	r.byName[cmd.Name()] = cmd
+}
+
+// withAliases adds aliases of registered commands, aliases of unknown commands are a programming error
+func (r *commandRegistry) withAliases(aliases map[language.Tag]map[string]string) *commandRegistry {
+	for _, v := range aliases {
+		for alias, name := range v {
+			if _, ok := r.byName[name]; !ok {
+				panic(fmt.Sprintf("alias %s of unknown command %s", alias, name))
+			}
+			r.aliases[strings.ToLower(alias)] = name
+		}
+	}
+
+	return r
+}
+
+func (r *commandRegistry) get(name string) (Command, bool) {
+	cmd, ok := r.byName[name]
+	return cmd, ok
+}
+
+// lookup returns the command by the case-insensitive name or alias
+func (r *commandRegistry) lookup(name string) (Command, bool) {
+	name = strings.ToLower(name)
+	if alias, ok := r.aliases[name]; ok {
+		name = alias
+	}
+
+	return r.get(name)
+}
+
+// all returns registered commands
+func (r *commandRegistry) all() []Command {
+	return r.commands
+}
+
+// names returns names of registered commands
+func (r *commandRegistry) names() []string {
+	res := make([]string, len(r.commands))
+	for k, v := range r.commands {
+		res[k] = v.Name()
+	}
+
+	return res
+}
+
+// credentials returns base credentials and credentials of the named commands without duplicates
+func (r *commandRegistry) credentials(names []string) []string {
+	var res []string
+	seen := map[string]bool{}
+
+	add := func(credentials []string) {
+		for _, v := range credentials {
+			if !seen[v] {
+				seen[v] = true
+				res = append(res, v)
+			}
+		}
+	}
+
+	add(baseCredentials)
+	for _, name := range names {
+		if cmd, ok := r.get(name); ok {
+			add(cmd.Credentials())
+		}
+	}
+
+	return res
+}
+
+// parse returns the command the text starts with and the parsed command line,
+// the command is nil when the text is not a registered command
+func (r *commandRegistry) parse(text string) (Command, commandLine) {
+	line := parseCommandLine(text)
+	if line.Name == "" {
+		return nil, line
+	}
+
+	cmd, ok := r.lookup(line.Name)
+	if !ok {
+		return nil, line
+	}
+
+	return cmd, line
+}
+
+type paymentCommand struct{}
+
+func (paymentCommand) Name() string        { return CommandPayment }
+func (paymentCommand) Description() string { return "get_payment" }
+func (paymentCommand) Usage() string       { return "usage_payment" }
+
+func (paymentCommand) Credentials() []string {
+	return []string{"/api/reference/payment-types"}
+}
+
+func (paymentCommand) Handle(w *Worker, req commandRequest) (string, v1.MessageProduct, error) {
+	res, err := w.paymentTypes()
+	if err != nil {
+		logger.Errorf("%s - Cannot retrieve payment types, error: %s", w.getCRMClient().URL, err.Error())
+		return "", v1.MessageProduct{}, err
+	}
+
+	var s []string
+	site := w.chatSite(req.ChatID)
+	for _, v := range res {
+		if v.Active && availableOnSite(v.Sites, site) {
+			s = append(s, v.Name)
+		}
+	}
+
+	return w.optionsReply(req.Localizer, replyPayment, "payment_options", s), v1.MessageProduct{}, nil
+}
+
+type deliveryCommand struct{}
+
+func (deliveryCommand) Name() string        { return CommandDelivery }
+func (deliveryCommand) Description() string { return "get_delivery" }
+func (deliveryCommand) Usage() string       { return "usage_delivery" }
+
+func (deliveryCommand) Credentials() []string {
+	return []string{"/api/reference/delivery-types"}
+}
+
+func (deliveryCommand) Handle(w *Worker, req commandRequest) (string, v1.MessageProduct, error) {
+	res, err := w.deliveryTypes()
+	if err != nil {
+		logger.Errorf("%s - Cannot retrieve delivery types, error: %s", w.getCRMClient().URL, err.Error())
+		return "", v1.MessageProduct{}, err
+	}
+
+	var s []string
+	site := w.chatSite(req.ChatID)
+	for _, v := range res {
+		if v.Active && availableOnSite(v.Sites, site) {
+			s = append(s, v.Name)
+		}
+	}
+
+	return w.optionsReply(req.Localizer, replyDelivery, "delivery_options", s), v1.MessageProduct{}, nil
+}
+
+type productCommand struct{}
+
+func (productCommand) Name() string        { return CommandProduct }
+func (productCommand) Description() string { return "get_product" }
+func (productCommand) Usage() string       { return "usage_product" }
+
+func (productCommand) Credentials() []string {
+	return []string{"/api/store/products"}
+}
+
+// Handle searches products on the chat site, the site flag overrides it
+func (productCommand) Handle(w *Worker, req commandRequest) (string, v1.MessageProduct, error) {
+	site, ok := req.Flags["site"]
+	if !ok {
+		return w.productCommand(req.Localizer, req.ChatID, req.Arg, w.chatSite(req.ChatID))
+	}
+
+	sites, err := w.sites()
+	if err != nil {
+		logger.Errorf("%s - Cannot retrieve sites, error: %s", w.getCRMClient().URL, err.Error())
+		return "", v1.MessageProduct{}, err
+	}
+
+	if _, ok := sites[site]; !ok {
+		return req.Localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID:    "unknown_site",
+			TemplateData: map[string]interface{}{"Site": site},
+		}), v1.MessageProduct{}, nil
+	}
+
+	return w.productCommand(req.Localizer, req.ChatID, req.Arg, site)
+}
+
+type orderCommand struct{}
+
+func (orderCommand) Name() string        { return CommandOrder }
+func (orderCommand) Description() string { return "get_order" }
+func (orderCommand) Usage() string       { return "usage_order" }
+
+func (orderCommand) Credentials() []string {
+	return []string{
+		"/api/orders",
+		"/api/reference/statuses",
+		"/api/reference/payment-statuses",
+		"/api/reference/delivery-types",
+	}
+}
+
+func (orderCommand) Handle(w *Worker, req commandRequest) (string, v1.MessageProduct, error) {
+	if req.Arg == "" {
+		return req.Localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "set_order_number"}), v1.MessageProduct{}, nil
+	}
+
+	res, err := w.orderInfo(req.Localizer, req.Arg)
+
+	return res, v1.MessageProduct{}, err
+}
+
+type helpCommand struct{}
+
+func (helpCommand) Name() string        { return CommandHelp }
+func (helpCommand) Description() string { return "get_help" }
+func (helpCommand) Usage() string       { return "usage_help" }
+
+func (helpCommand) Credentials() []string {
+	return nil
+}
+
+// Handle lists enabled commands or returns usage of the command passed as the argument
+func (helpCommand) Handle(w *Worker, req commandRequest) (string, v1.MessageProduct, error) {
+	conn := w.getConnection()
+
+	if len(req.Args) > 0 {
+		cmd, ok := botCommands.lookup("/" + strings.TrimPrefix(req.Args[0], "/"))
+		if !ok || !conn.isCommandEnabled(cmd.Name()) {
+			return req.Localizer.MustLocalize(&i18n.LocalizeConfig{
+				MessageID:    "help_unknown_command",
+				TemplateData: map[string]interface{}{"Command": req.Args[0]},
+			}), v1.MessageProduct{}, nil
+		}
+
+		return req.Localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: cmd.Usage()}), v1.MessageProduct{}, nil
+	}
+
+	return helpText(req.Localizer, conn.isCommandEnabled), v1.MessageProduct{}, nil
+}
+
+// helpText returns the list of enabled commands with their descriptions
+func helpText(loc *i18n.Localizer, enabled func(command string) bool) string {
+	var s []string
+	for _, cmd := range botCommands.all() {
+		if enabled(cmd.Name()) {
+			s = append(s, fmt.Sprintf(
+				"%s - %s",
+				cmd.Name(),
+				loc.MustLocalize(&i18n.LocalizeConfig{MessageID: cmd.Description()}),
+			))
+		}
+	}
+
+	return fmt.Sprintf(
+		"%s\n\n%s\n\n%s",
+		loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "help_commands"}),
+		strings.Join(s, "\n"),
+		loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "help_usage"}),
+	)
+}
+
+// optionsReply returns the list of options rendered with the reply template
+// or the not found message
+func (w *Worker) optionsReply(loc *i18n.Localizer, reply, header string, s []string) string {
+	if len(s) == 0 {
+		return loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "not_found"})
+	}
+
+	return w.renderReply(reply, listReplyData{Items: s}, func() string {
+		return optionsList(loc, header, s)
+	})
+}
+
+// optionsList returns the default list of options under the header
+func optionsList(loc *i18n.Localizer, header string, s []string) string {
+	if len(s) > 1 {
+		s = numberedList(s)
+	}
+
+	return fmt.Sprintf(
+		"%s\n\n%s",
+		loc.MustLocalize(&i18n.LocalizeConfig{MessageID: header}),
+		strings.Join(s, "\n"),
+	)
+}
@@ -10,13 +10,20 @@ import (
 
 // BotConfig struct
 type BotConfig struct {
-	Version    string           `yaml:"version"`
-	LogLevel   logging.Level    `yaml:"log_level"`
-	Database   DatabaseConfig   `yaml:"database"`
-	SentryDSN  string           `yaml:"sentry_dsn"`
-	HTTPServer HTTPServerConfig `yaml:"http_server"`
-	Debug      bool             `yaml:"debug"`
-	BotInfo    BotInfo          `yaml:"bot_info"`
+	Version         string           `yaml:"version"`
+	LogLevel        logging.Level    `yaml:"log_level"`
+	Database        DatabaseConfig   `yaml:"database"`
+	SentryDSN       string           `yaml:"sentry_dsn"`
+	HTTPServer      HTTPServerConfig `yaml:"http_server"`
+	Debug           bool             `yaml:"debug"`
+	BotInfo         BotInfo          `yaml:"bot_info"`
+	Reconnect       ReconnectConfig  `yaml:"reconnect"`
+	ShutdownTimeout int              `yaml:"shutdown_timeout"`
+	Admin           AdminConfig      `yaml:"admin"`
+	Health          HealthConfig     `yaml:"health"`
+	Cache           CacheConfig      `yaml:"cache"`
+	RateLimit       RateLimitConfig  `yaml:"rate_limit"`
+	Commands        CommandsConfig   `yaml:"commands"`
 }
 
 type BotInfo struct {
@@ -35,6 +42,44 @@ type DatabaseConfig struct {
 	ConnectionLifetime int    `yaml:"connection_lifetime"`
 }
 
+// ReconnectConfig struct, delays are in seconds
+type ReconnectConfig struct {
+	BaseDelay        int `yaml:"base_delay"`
+	MaxDelay         int `yaml:"max_delay"`
+	FailureThreshold int `yaml:"failure_threshold"`
+	OpenTimeout      int `yaml:"open_timeout"`
+}
+
+// AdminConfig struct, admin API is disabled when token is empty
+type AdminConfig struct {
+	Token string `yaml:"token"`
+}
+
+// HealthConfig struct, readiness thresholds
+type HealthConfig struct {
+	DBTimeout         int     `yaml:"db_timeout"`
+	MinConnectedRatio float64 `yaml:"min_connected_ratio"`
+}
+
+// CacheConfig struct, TTLs are in seconds
+type CacheConfig struct {
+	ReferenceTTL int `yaml:"reference_ttl"`
+}
+
+// RateLimitConfig struct, rates are commands per minute
+type RateLimitConfig struct {
+	ChatRate        int `yaml:"chat_rate"`
+	ChatBurst       int `yaml:"chat_burst"`
+	ConnectionRate  int `yaml:"connection_rate"`
+	ConnectionBurst int `yaml:"connection_burst"`
+}
+
+// CommandsConfig struct, limits concurrent commands of a worker
+type CommandsConfig struct {
+	Concurrency int `yaml:"concurrency"`
+	QueueSize   int `yaml:"queue_size"`
+}
+
 // HTTPServerConfig struct
 type HTTPServerConfig struct {
 	Host   string `yaml:"host"`
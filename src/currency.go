@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	v5 "github.com/retailcrm/api-client-go/v5"
+	"golang.org/x/text/currency"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+const defaultCurrency = "rub"
+
+// crmSite is a CRM site, v5.Site misses the site currency
+type crmSite struct {
+	Code     string `json:"code"`
+	Name     string `json:"name"`
+	Currency string `json:"currency"`
+}
+
+// currencyCodes returns ISO 4217 tender currencies by labels for the settings form,
+// codes are lower-cased as MG expects them
+func currencyCodes() map[string]string {
+	res := map[string]string{}
+	p := message.NewPrinter(language.English)
+
+	it := currency.Query(currency.Date(time.Now()))
+	for it.Next() {
+		if !it.IsTender() {
+			continue
+		}
+
+		unit := it.Unit()
+		label := unit.String()
+		if symbol := p.Sprint(currency.NarrowSymbol(unit)); symbol != label {
+			label = fmt.Sprintf("%s (%s)", label, symbol)
+		}
+
+		res[label] = strings.ToLower(unit.String())
+	}
+
+	return res
+}
+
+// currencyOptions returns currencies for the settings form, the connection currency
+// missing from the list is added so saving the form keeps it
+func currencyOptions(current string) map[string]string {
+	res := make(map[string]string, len(currencies)+1)
+	found := false
+	for k, v := range currencies {
+		res[k] = v
+		found = found || v == current
+	}
+
+	if current != "" && !found {
+		res[strings.ToUpper(current)] = current
+	}
+
+	return res
+}
+
+// getSites returns CRM sites with their currencies by codes
+func getSites(client *v5.Client) (map[string]crmSite, error) {
+	var res struct {
+		Sites map[string]crmSite `json:"sites"`
+	}
+
+	if err := getReference(client, "/reference/sites", &res); err != nil {
+		return nil, err
+	}
+
+	return res.Sites, nil
+}
+
+// sitesCurrency returns the currency of the first site with the currency set
+func sitesCurrency(sites map[string]crmSite) string {
+	codes := make([]string, 0, len(sites))
+	for k := range sites {
+		codes = append(codes, k)
+	}
+	sort.Strings(codes)
+
+	for _, code := range codes {
+		if sites[code].Currency != "" {
+			return strings.ToLower(sites[code].Currency)
+		}
+	}
+
+	return defaultCurrency
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"text/template"
+	"time"
+
+	v1 "github.com/retailcrm/mg-bot-api-client-go/v1"
+)
+
+const (
+	// farewellGrace is the time a dialog opened after the farewell is not greeted,
+	// the farewell itself may open a new dialog
+	farewellGrace = time.Minute
+	// chatDialogTTL is the time the dialog state is trusted without events of the chat
+	chatDialogTTL = 24 * time.Hour
+	// editedContentTTL is the time contents of edited messages are remembered to skip status updates
+	editedContentTTL = 24 * time.Hour
+)
+
+// eventSettings configure replies to MG chat events of a connection
+type eventSettings struct {
+	// Greeting is sent to the customer when a dialog opens
+	Greeting string `json:"greeting"`
+	// Farewell is sent to the customer when a dialog closes
+	Farewell string `json:"farewell"`
+	// RerunEdited runs a command again when its message is edited
+	RerunEdited bool `json:"rerun_edited"`
+}
+
+// chatDialog is the state of the chat dialog known from MG events
+type chatDialog struct {
+	Assigned   bool
+	FarewellAt time.Time
+	UpdatedAt  time.Time
+}
+
+// editedContent is the handled content of the edited message
+type editedContent struct {
+	Content   string
+	UpdatedAt time.Time
+}
+
+// eventTemplateData is passed to greeting and farewell templates
+type eventTemplateData struct {
+	// Name is the customer name
+	Name string
+}
+
+// validate checks greeting and farewell templates
+func (s eventSettings) validate() error {
+	for _, v := range []string{s.Greeting, s.Farewell} {
+		if _, err := parseEventTemplate(v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseEventTemplate(text string) (*template.Template, error) {
+	return template.New("event").Funcs(limitedFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// executeEventTemplate returns the greeting or farewell for the chat customer
+func executeEventTemplate(text string, chat *v1.Chat) (string, error) {
+	tmpl, err := parseEventTemplate(text)
+	if err != nil {
+		return "", err
+	}
+
+	var data eventTemplateData
+	if chat.Customer != nil {
+		data.Name = chat.Customer.Name
+	}
+
+	return executeTemplate(tmpl, data)
+}
+
+// unmarshalEvent decodes the event data, errors are reported to Sentry
+func (w *Worker) unmarshalEvent(wsEvent v1.WsEvent, data interface{}) bool {
+	if err := json.Unmarshal(wsEvent.Data, data); err != nil {
+		w.sendSentry(err)
+		return false
+	}
+
+	return true
+}
+
+// handleMessageUpdated runs the edited command again when it is enabled for the connection
+func (w *Worker) handleMessageUpdated(message *v1.Message) {
+	if message == nil || !message.IsEdit || message.Type != v1.MsgTypeCommand ||
+		message.TextMessage == nil || (message.From != nil && message.From.Type == "bot") ||
+		!w.getConnection().getEventSettings().RerunEdited {
+		return
+	}
+
+	// message status updates are sent as updates of the edited message too
+	if !w.setEditedContent(message.ID, message.Content) {
+		return
+	}
+
+	w.handleCommand(message)
+}
+
+// handleChatCreated remembers the channel of the new chat, channels are only needed
+// when channels are mapped to sites
+func (w *Worker) handleChatCreated(chat *v1.Chat) {
+	if chat == nil || chat.Channel == nil || len(w.getConnection().getChannelSites()) == 0 {
+		return
+	}
+
+	w.setChatChannel(chat.ID, chat.Channel.ID)
+}
+
+// handleDialogOpened greets the customer of the new dialog
+func (w *Worker) handleDialogOpened(dialog *v1.Dialog) {
+	if dialog == nil || dialog.Chat == nil {
+		return
+	}
+
+	chatID := dialog.Chat.ID
+	state := w.setChatDialog(chatID, func(d *chatDialog) {
+		d.Assigned = isOperatorResponsible(dialog.Responsible)
+	})
+
+	greeting := w.getConnection().getEventSettings().Greeting
+	if greeting == "" || time.Since(state.FarewellAt) < farewellGrace {
+		return
+	}
+
+	w.enqueue(chatID, func() {
+		w.sendEventMessage(dialog.Chat, greeting)
+	})
+}
+
+// handleDialogClosed says farewell to the customer of the closed dialog
+func (w *Worker) handleDialogClosed(dialog *v1.Dialog) {
+	if dialog == nil || dialog.Chat == nil {
+		return
+	}
+
+	farewell := w.getConnection().getEventSettings().Farewell
+	w.setChatDialog(dialog.Chat.ID, func(d *chatDialog) {
+		d.Assigned = false
+		if farewell != "" {
+			d.FarewellAt = time.Now()
+		}
+	})
+
+	if farewell == "" {
+		return
+	}
+
+	w.enqueue(dialog.Chat.ID, func() {
+		w.sendEventMessage(dialog.Chat, farewell)
+	})
+}
+
+// handleDialogAssign remembers whether an operator is responsible for the chat dialog
+func (w *Worker) handleDialogAssign(data v1.WsEventDialogAssignData) {
+	chat := data.Chat
+	if chat == nil && data.Dialog != nil {
+		chat = data.Dialog.Chat
+	}
+
+	if chat == nil || data.Dialog == nil {
+		return
+	}
+
+	w.setChatDialog(chat.ID, func(d *chatDialog) {
+		d.Assigned = isOperatorResponsible(data.Dialog.Responsible)
+	})
+}
+
+// sendEventMessage sends the greeting or farewell template to the chat customer
+func (w *Worker) sendEventMessage(chat *v1.Chat, text string) {
+	msg, err := executeEventTemplate(text, chat)
+	if err != nil {
+		w.logger.Warningf("%s - Cannot execute event template, error: %v", w.getConnection().APIURL, err)
+		return
+	}
+
+	if msg == "" {
+		return
+	}
+
+	w.sendReply(w.getLocalizer(), chat.ID, v1.MessageScopePublic, msg, v1.MessageProduct{})
+}
+
+func isOperatorResponsible(r *v1.Responsible) bool {
+	return r != nil && r.Type == "user"
+}
+
+// getChatDialog returns the dialog state of the chat, false means it is unknown
+func (w *Worker) getChatDialog(chatID uint64) (chatDialog, bool) {
+	w.dialogMutex.Lock()
+	defer w.dialogMutex.Unlock()
+
+	d, ok := w.dialogs[chatID]
+	if !ok || time.Since(d.UpdatedAt) > chatDialogTTL {
+		return chatDialog{}, false
+	}
+
+	return d, true
+}
+
+// setChatDialog updates the dialog state of the chat and returns the previous one
+func (w *Worker) setChatDialog(chatID uint64, update func(d *chatDialog)) chatDialog {
+	w.dialogMutex.Lock()
+	defer w.dialogMutex.Unlock()
+
+	now := time.Now()
+	w.sweepDialogs(now)
+
+	prev, ok := w.dialogs[chatID]
+	if !ok || now.Sub(prev.UpdatedAt) > chatDialogTTL {
+		prev = chatDialog{}
+	}
+
+	d := prev
+	update(&d)
+	d.UpdatedAt = now
+	w.dialogs[chatID] = d
+
+	return prev
+}
+
+// setEditedContent remembers the content of the edited message,
+// it returns false when the content was already handled
+func (w *Worker) setEditedContent(messageID uint64, content string) bool {
+	w.dialogMutex.Lock()
+	defer w.dialogMutex.Unlock()
+
+	now := time.Now()
+	w.sweepDialogs(now)
+
+	if v, ok := w.edits[messageID]; ok && v.Content == content && now.Sub(v.UpdatedAt) <= editedContentTTL {
+		return false
+	}
+	w.edits[messageID] = editedContent{Content: content, UpdatedAt: now}
+
+	return true
+}
+
+// sweepDialogs drops expired dialog states and edited contents,
+// the caller holds dialogMutex
+func (w *Worker) sweepDialogs(now time.Time) {
+	if now.Sub(w.dialogsSweep) < chatDialogTTL {
+		return
+	}
+
+	for k, v := range w.dialogs {
+		if now.Sub(v.UpdatedAt) > chatDialogTTL {
+			delete(w.dialogs, k)
+		}
+	}
+
+	for k, v := range w.edits {
+		if now.Sub(v.UpdatedAt) > editedContentTTL {
+			delete(w.edits, k)
+		}
+	}
+	w.dialogsSweep = now
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultHealthDBTimeout = 2 * time.Second
+
+// healthCheck is a single readiness check result
+type healthCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// workersCheck reports how many workers are connected to MG
+type workersCheck struct {
+	OK        bool    `json:"ok"`
+	Total     int     `json:"total"`
+	Connected int     `json:"connected"`
+	Ratio     float64 `json:"ratio"`
+	MinRatio  float64 `json:"minRatio"`
+}
+
+func healthHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func readyHandler(c *gin.Context) {
+	db := checkDatabase()
+	translations := healthCheck{OK: translationsLoaded()}
+	if !translations.OK {
+		translations.Error = "translations are not loaded"
+	}
+	workers := checkWorkers()
+
+	status := http.StatusOK
+	res := "ok"
+	if !db.OK || !translations.OK || !workers.OK {
+		status = http.StatusServiceUnavailable
+		res = "fail"
+	}
+
+	c.JSON(status, gin.H{
+		"status":       res,
+		"database":     db,
+		"translations": translations,
+		"workers":      workers,
+	})
+}
+
+func checkDatabase() (res healthCheck) {
+	if orm == nil || orm.DB == nil {
+		res.Error = "database is not initialized"
+		return
+	}
+
+	timeout := time.Duration(config.Health.DBTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultHealthDBTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := orm.DB.DB().PingContext(ctx); err != nil {
+		res.Error = err.Error()
+		return
+	}
+
+	res.OK = true
+	return
+}
+
+// checkWorkers compares the connected workers ratio with the configured minimum,
+// the check always passes when the minimum is not set
+func checkWorkers() (res workersCheck) {
+	res.MinRatio = config.Health.MinConnectedRatio
+
+	for _, w := range wm.listWorkers() {
+		res.Total++
+		if w.Info().Connected {
+			res.Connected++
+		}
+	}
+
+	res.Ratio = 1
+	if res.Total > 0 {
+		res.Ratio = float64(res.Connected) / float64(res.Total)
+	}
+
+	res.OK = res.MinRatio <= 0 || res.Ratio >= res.MinRatio
+	return
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"time"
+	"unicode"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	v1 "github.com/retailcrm/mg-bot-api-client-go/v1"
+	"golang.org/x/text/language"
+)
+
+const (
+	chatLangTTL = 24 * time.Hour
+	// chatLangFailureTTL is the time the connection language is used after a failed lookup
+	chatLangFailureTTL = 5 * time.Minute
+)
+
+// chatLang is the language of the chat customer profile, empty when the profile has none
+// or it could not be retrieved
+type chatLang struct {
+	Lang      string
+	ExpiresAt time.Time
+}
+
+// chatLocalizer returns the localizer for the customer language of the chat,
+// it falls back to the connection language when the language is unknown
+func (w *Worker) chatLocalizer(message *v1.Message) *i18n.Localizer {
+	lang, ok := w.getChatLang(message.ChatID)
+
+	if !ok {
+		var err error
+		lang, err = w.chatCustomerLang(message)
+		if err != nil {
+			w.logger.Warningf("%s - Cannot retrieve customer of chat %d, error: %v", w.getConnection().APIURL, message.ChatID, err)
+			w.setChatLang(message.ChatID, "", chatLangFailureTTL)
+		} else {
+			w.setChatLang(message.ChatID, lang, chatLangTTL)
+		}
+	}
+
+	if lang == "" && message.TextMessage != nil {
+		lang = detectLang(message.Content)
+	}
+
+	if lang == "" {
+		return w.getLocalizer()
+	}
+
+	return getLang(lang)
+}
+
+// chatCustomerLang returns the language of the chat customer profile,
+// commands are sent by operators so the customer is taken from the chat
+func (w *Worker) chatCustomerLang(message *v1.Message) (string, error) {
+	var customerID uint64
+
+	if message.From != nil && message.From.Type == "customer" {
+		customerID = message.From.ID
+	} else {
+		chats, _, err := w.getMGClient().Chats(v1.ChatsRequest{ID: message.ChatID})
+		if err != nil {
+			return "", err
+		}
+
+		if len(chats) > 0 {
+			customerID = chats[0].Customer.ID
+		}
+	}
+
+	if customerID == 0 {
+		return "", nil
+	}
+
+	return w.customerLang(customerID)
+}
+
+// customerLang returns the supported language of the MG customer profile
+func (w *Worker) customerLang(customerID uint64) (string, error) {
+	customers, _, err := w.getMGClient().Customers(v1.CustomersRequest{ID: customerID})
+	if err != nil {
+		return "", err
+	}
+
+	if len(customers) == 0 || customers[0].Language == "" {
+		return "", nil
+	}
+
+	return supportedLang(customers[0].Language), nil
+}
+
+// supportedLang returns the base of the supported language matching lang or an empty string
+func supportedLang(lang string) string {
+	tag, err := language.Parse(lang)
+	if err != nil {
+		return ""
+	}
+
+	res, _, confidence := matcher.Match(tag)
+	if confidence == language.No {
+		return ""
+	}
+
+	base, _ := res.Base()
+
+	return base.String()
+}
+
+// detectLang guesses the language by the letters of the text,
+// only languages with distinctive letters are detected
+func detectLang(text string) string {
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.Cyrillic, r):
+			return "ru"
+		case r == 'ñ' || r == 'Ñ' || r == '¿' || r == '¡':
+			return "es"
+		}
+	}
+
+	return ""
+}
+
+func (w *Worker) getChatLang(chatID uint64) (string, bool) {
+	w.langMutex.Lock()
+	defer w.langMutex.Unlock()
+
+	l, ok := w.langs[chatID]
+	if !ok || time.Now().After(l.ExpiresAt) {
+		return "", false
+	}
+
+	return l.Lang, true
+}
+
+// setChatLang caches the chat language for the TTL, expired languages are swept periodically
+func (w *Worker) setChatLang(chatID uint64, lang string, ttl time.Duration) {
+	w.langMutex.Lock()
+	defer w.langMutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(w.langsSweep) >= chatLangTTL {
+		for k, v := range w.langs {
+			if now.After(v.ExpiresAt) {
+				delete(w.langs, k)
+			}
+		}
+		w.langsSweep = now
+	}
+
+	w.langs[chatID] = chatLang{Lang: lang, ExpiresAt: now.Add(ttl)}
+}
@@ -12,11 +12,13 @@ import (
 var (
 	localizer *i18n.Localizer
 	bundle    = &i18n.Bundle{DefaultLanguage: language.English}
-	matcher   = language.NewMatcher([]language.Tag{
+	languages = []language.Tag{
 		language.English,
 		language.Russian,
 		language.Spanish,
-	})
+	}
+	matcher         = language.NewMatcher(languages)
+	loadedLanguages = map[language.Tag]bool{}
 )
 
 func loadTranslateFile() {
@@ -27,9 +29,24 @@ func loadTranslateFile() {
 	}
 	for _, f := range files {
 		if !f.IsDir() {
-			bundle.MustLoadMessageFile("translate/" + f.Name())
+			mf, err := bundle.LoadMessageFile("translate/" + f.Name())
+			if err != nil {
+				panic(err)
+			}
+			loadedLanguages[mf.Tag] = true
+		}
+	}
+}
+
+// translationsLoaded checks that message files were loaded for every supported language
+func translationsLoaded() bool {
+	for _, tag := range languages {
+		if !loadedLanguages[tag] {
+			return false
 		}
 	}
+
+	return true
 }
 
 func setLocale(al string) {
@@ -52,6 +69,23 @@ func getLocale() map[string]interface{} {
 		"TableActivity": getLocalizedMessage("table_activity"),
 		"Title":         getLocalizedMessage("title"),
 		"Language":      getLocalizedMessage("language"),
+		"Commands":      getLocalizedMessage("commands"),
+		"ShowStock":     getLocalizedMessage("show_stock"),
+		"PriceTypes":    getLocalizedMessage("price_types"),
+		"ChannelSites":  getLocalizedMessage("channel_sites"),
+		"AllSites":      getLocalizedMessage("all_sites"),
+		"AutoAnswers":   getLocalizedMessage("auto_answers"),
+		"Keywords":      getLocalizedMessage("auto_answer_keywords"),
+		"Regexp":        getLocalizedMessage("auto_answer_regexp"),
+		"Reply":         getLocalizedMessage("auto_answer_reply"),
+		"AddAnswer":     getLocalizedMessage("auto_answer_add"),
+		"Unassigned":    getLocalizedMessage("auto_answers_unassigned"),
+		"Dialogs":       getLocalizedMessage("dialog_events"),
+		"Greeting":      getLocalizedMessage("greeting"),
+		"Farewell":      getLocalizedMessage("farewell"),
+		"RerunEdited":   getLocalizedMessage("rerun_edited"),
+		"Replies":       getLocalizedMessage("reply_templates"),
+		"Preview":       getLocalizedMessage("reply_preview"),
 		"CRMLink":       template.HTML(getLocalizedMessage("crm_link")),
 		"DocLink":       template.HTML(getLocalizedMessage("doc_link")),
 	}
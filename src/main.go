@@ -19,14 +19,7 @@ var (
 	options      Options
 	tokenCounter uint32
 	parser       = flags.NewParser(&options, flags.Default)
-	currency     = map[string]string{
-		"Российский рубль":  "rub",
-		"Гри́вня":           "uah",
-		"Беларускі рубель":  "byr",
-		"Қазақстан теңгесі": "kzt",
-		"U.S. dollar":       "usd",
-		"Euro":              "eur",
-	}
+	currencies   = currencyCodes()
 )
 
 func main() {
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// splitMessage splits text into parts of at most limit bytes on line boundaries,
+// every part except the last one ends with the continued marker.
+// Lines longer than a part are split on rune boundaries
+func splitMessage(text string, limit int, continued string) []string {
+	if len(text) <= limit {
+		return []string{text}
+	}
+
+	size := limit - len(continued) - 1
+	if size <= 0 {
+		size = limit
+		continued = ""
+	}
+
+	var (
+		parts []string
+		cur   string
+	)
+
+	flush := func() {
+		if cur != "" {
+			parts = append(parts, cur)
+			cur = ""
+		}
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		for len(line) > size {
+			flush()
+			n := runePrefix(line, size)
+			parts = append(parts, line[:n])
+			line = line[n:]
+		}
+
+		switch {
+		case cur == "":
+			cur = line
+		case len(cur)+1+len(line) <= size:
+			cur += "\n" + line
+		default:
+			flush()
+			cur = line
+		}
+	}
+	flush()
+
+	if continued != "" {
+		for k := range parts[:len(parts)-1] {
+			parts[k] += "\n" + continued
+		}
+	}
+
+	return parts
+}
+
+// runePrefix returns the length of the longest prefix of s not longer than n bytes
+// which doesn't split a rune, but at least the first rune
+func runePrefix(s string, n int) int {
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	if n == 0 {
+		_, n = utf8.DecodeRuneInString(s)
+	}
+
+	return n
+}
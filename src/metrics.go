@@ -0,0 +1,182 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "mg_bot"
+
+var (
+	wsEventsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "ws_events_total",
+			Help:      "Websocket events received from MG.",
+		},
+		[]string{"type"},
+	)
+	commandsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "commands_total",
+			Help:      "Bot commands executed.",
+		},
+		[]string{"command", "result"},
+	)
+	commandsRejectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "commands_rejected_total",
+			Help:      "Bot commands rejected by the rate limiter.",
+		},
+		[]string{"scope"},
+	)
+	tasksDroppedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "tasks_dropped_total",
+			Help:      "Commands and event replies dropped because the chat queue was full.",
+		},
+	)
+	autoAnswersTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "auto_answers_total",
+			Help:      "Auto answers to customer messages.",
+		},
+		[]string{"result"},
+	)
+	messageSendFailuresTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "message_send_failures_total",
+			Help:      "Failed MessageSend calls to MG.",
+		},
+	)
+	referenceCacheTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "reference_cache_total",
+			Help:      "CRM reference cache lookups.",
+		},
+		[]string{"reference", "result"},
+	)
+	crmRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "crm_request_duration_seconds",
+			Help:      "CRM API call latency.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"method"},
+	)
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP handlers latency.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"method", "path", "status"},
+	)
+	activeWorkers = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "active_workers",
+			Help:      "Workers running for active connections.",
+		},
+		func() float64 {
+			return float64(len(wm.listWorkers()))
+		},
+	)
+	commandsQueueDepth = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "commands_queue_depth",
+			Help:      "Commands waiting in worker pools.",
+		},
+		func() float64 {
+			var n int
+			for _, w := range wm.listWorkers() {
+				n += w.pool.Len()
+			}
+			return float64(n)
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		wsEventsTotal,
+		commandsTotal,
+		commandsRejectedTotal,
+		tasksDroppedTotal,
+		autoAnswersTotal,
+		messageSendFailuresTotal,
+		referenceCacheTotal,
+		crmRequestDuration,
+		httpRequestDuration,
+		activeWorkers,
+		commandsQueueDepth,
+	)
+}
+
+// crmRequestTimer returns a function observing the CRM call latency since the crmRequestTimer call
+func crmRequestTimer(method string) func() {
+	timer := prometheus.NewTimer(crmRequestDuration.WithLabelValues(method))
+
+	return timer.ObserveDuration
+}
+
+// commandResult returns result label for commands_total
+func commandResult(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "success"
+}
+
+// metricsMiddleware observes handlers latency labeled with the registered route pattern,
+// requests not matching a route share one label so clients cannot add label values
+func metricsMiddleware(r *gin.Engine) gin.HandlerFunc {
+	var (
+		once   sync.Once
+		routes map[string]string
+	)
+
+	return func(c *gin.Context) {
+		// routes are registered after the middleware, so they are indexed on the first request
+		once.Do(func() {
+			routes = routePatterns(r.Routes())
+		})
+
+		start := time.Now()
+		c.Next()
+
+		method := c.Request.Method
+		path, ok := routes[method+" "+c.HandlerName()]
+		if !ok {
+			method, path = "other", "unmatched"
+		}
+
+		httpRequestDuration.
+			WithLabelValues(method, path, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// routePatterns returns route patterns by methods and handler names
+func routePatterns(routes gin.RoutesInfo) map[string]string {
+	res := make(map[string]string, len(routes))
+	for _, v := range routes {
+		res[v.Method+" "+v.Handler] = v.Path
+	}
+
+	return res
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"strings"
 	"time"
 
 	"github.com/jinzhu/gorm/dialects/postgres"
@@ -8,16 +10,176 @@ import (
 
 // Connection model
 type Connection struct {
-	ID        int    `gorm:"primary_key"`
-	ClientID  string `gorm:"client_id type:varchar(70);not null;unique" json:"clientId,omitempty"`
-	APIKEY    string `gorm:"api_key type:varchar(100);not null" json:"api_key,omitempty" binding:"required"`
-	APIURL    string `gorm:"api_url type:varchar(255);not null" json:"api_url,omitempty" binding:"required,validatecrmurl"`
-	MGURL     string `gorm:"mg_url type:varchar(255);not null;" json:"mg_url,omitempty"`
-	MGToken   string `gorm:"mg_token type:varchar(100);not null;unique" json:"mg_token,omitempty"`
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	Active    bool           `json:"active,omitempty"`
-	Commands  postgres.Jsonb `gorm:"commands type:jsonb;" json:"commands,omitempty"`
-	Lang      string         `gorm:"lang type:varchar(2)" json:"lang,omitempty"`
-	Currency  string         `gorm:"currency type:varchar(12)" json:"currency,omitempty"`
+	ID         int    `gorm:"primary_key"`
+	ClientID   string `gorm:"client_id type:varchar(70);not null;unique" json:"clientId,omitempty"`
+	APIKEY     string `gorm:"api_key type:varchar(100);not null" json:"api_key,omitempty" binding:"required"`
+	APIURL     string `gorm:"api_url type:varchar(255);not null" json:"api_url,omitempty" binding:"required,validatecrmurl"`
+	MGURL      string `gorm:"mg_url type:varchar(255);not null;" json:"mg_url,omitempty"`
+	MGToken    string `gorm:"mg_token type:varchar(100);not null;unique" json:"mg_token,omitempty"`
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+	Active     bool           `json:"active,omitempty"`
+	Commands   postgres.Jsonb `gorm:"commands type:jsonb;" json:"commands,omitempty"`
+	Lang       string         `gorm:"lang type:varchar(2)" json:"lang,omitempty"`
+	Currency   string         `gorm:"currency type:varchar(12)" json:"currency,omitempty"`
+	ShowStock  bool           `gorm:"show_stock" json:"show_stock,omitempty"`
+	PriceTypes postgres.Jsonb `gorm:"price_types type:jsonb;" json:"price_types,omitempty"`
+	Sites      postgres.Jsonb `gorm:"sites type:jsonb;" json:"sites,omitempty"`
+	Answers    postgres.Jsonb `gorm:"answers type:jsonb;" json:"answers,omitempty"`
+	Events     postgres.Jsonb `gorm:"events type:jsonb;" json:"events,omitempty"`
+	Replies    postgres.Jsonb `gorm:"replies type:jsonb;" json:"replies,omitempty"`
+}
+
+// getCommands returns commands enabled for the connection
+func (c *Connection) getCommands() []string {
+	var commands []string
+
+	if len(c.Commands.RawMessage) == 0 {
+		return botCommands.names()
+	}
+
+	if err := json.Unmarshal(c.Commands.RawMessage, &commands); err != nil || commands == nil {
+		return botCommands.names()
+	}
+
+	return commands
+}
+
+// setCommands stores enabled commands, unknown commands are skipped
+func (c *Connection) setCommands(commands []string) {
+	enabled := []string{}
+
+	for _, cmd := range botCommands.names() {
+		for _, v := range commands {
+			if v == cmd {
+				enabled = append(enabled, cmd)
+				break
+			}
+		}
+	}
+
+	c.Commands.RawMessage, _ = json.Marshal(enabled)
+}
+
+// getPriceTypes returns codes of price types shown in product replies,
+// the base price is shown when the list is empty
+func (c *Connection) getPriceTypes() []string {
+	var priceTypes []string
+
+	if len(c.PriceTypes.RawMessage) == 0 {
+		return priceTypes
+	}
+
+	json.Unmarshal(c.PriceTypes.RawMessage, &priceTypes)
+
+	return priceTypes
+}
+
+func (c *Connection) setPriceTypes(priceTypes []string) {
+	if priceTypes == nil {
+		priceTypes = []string{}
+	}
+
+	c.PriceTypes.RawMessage, _ = json.Marshal(priceTypes)
+}
+
+// getChannelSites returns CRM site codes by MG channel IDs
+func (c *Connection) getChannelSites() map[string]string {
+	sites := map[string]string{}
+
+	if len(c.Sites.RawMessage) != 0 {
+		json.Unmarshal(c.Sites.RawMessage, &sites)
+	}
+
+	return sites
+}
+
+// setChannelSites stores channel sites, channels without a site are skipped
+func (c *Connection) setChannelSites(sites map[string]string) {
+	res := map[string]string{}
+	for k, v := range sites {
+		if v != "" {
+			res[k] = v
+		}
+	}
+
+	c.Sites.RawMessage, _ = json.Marshal(res)
+}
+
+// getAutoAnswers returns auto answer rules of the connection
+func (c *Connection) getAutoAnswers() autoAnswers {
+	var res autoAnswers
+
+	if len(c.Answers.RawMessage) != 0 {
+		json.Unmarshal(c.Answers.RawMessage, &res)
+	}
+
+	return res
+}
+
+func (c *Connection) setAutoAnswers(answers autoAnswers) {
+	if answers.Rules == nil {
+		answers.Rules = []autoAnswerRule{}
+	}
+
+	c.Answers.RawMessage, _ = json.Marshal(answers)
+}
+
+// getEventSettings returns replies to MG chat events of the connection
+func (c *Connection) getEventSettings() eventSettings {
+	var res eventSettings
+
+	if len(c.Events.RawMessage) != 0 {
+		json.Unmarshal(c.Events.RawMessage, &res)
+	}
+
+	return res
+}
+
+func (c *Connection) setEventSettings(settings eventSettings) {
+	c.Events.RawMessage, _ = json.Marshal(settings)
+}
+
+// getReplyTemplates returns reply templates overridden by the connection by reply names
+func (c *Connection) getReplyTemplates() map[string]string {
+	res := map[string]string{}
+
+	if len(c.Replies.RawMessage) != 0 {
+		json.Unmarshal(c.Replies.RawMessage, &res)
+	}
+
+	return res
+}
+
+// setReplyTemplates stores reply templates, empty templates and unknown replies are skipped
+func (c *Connection) setReplyTemplates(templates map[string]string) {
+	res := map[string]string{}
+
+	for _, v := range replyTemplates {
+		if text := templates[v.Name]; strings.TrimSpace(text) != "" {
+			res[v.Name] = text
+		}
+	}
+
+	c.Replies.RawMessage, _ = json.Marshal(res)
+}
+
+func (c *Connection) isPriceTypeEnabled(code string) bool {
+	for _, v := range c.getPriceTypes() {
+		if v == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Connection) isCommandEnabled(command string) bool {
+	for _, v := range c.getCommands() {
+		if v == command {
+			return true
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,68 @@
+package main
+
+import "sync"
+
+const (
+	defaultCommandsConcurrency = 4
+	defaultCommandsQueueSize   = 100
+)
+
+// commandPool runs tasks concurrently on a fixed number of goroutines,
+// tasks with the same key are always run by the same goroutine in submission order
+type commandPool struct {
+	queues []chan func()
+	wg     sync.WaitGroup
+}
+
+func newCommandPool(c CommandsConfig) *commandPool {
+	concurrency, queueSize := c.Concurrency, c.QueueSize
+	if concurrency <= 0 {
+		concurrency = defaultCommandsConcurrency
+	}
+
+	if queueSize <= 0 {
+		queueSize = defaultCommandsQueueSize
+	}
+
+	p := &commandPool{queues: make([]chan func(), concurrency)}
+	for k := range p.queues {
+		p.queues[k] = make(chan func(), queueSize/concurrency+1)
+	}
+
+	return p
+}
+
+// Start runs the pool goroutines
+func (p *commandPool) Start() {
+	for _, q := range p.queues {
+		p.wg.Add(1)
+		go func(q chan func()) {
+			defer p.wg.Done()
+			for task := range q {
+				task()
+			}
+		}(q)
+	}
+}
+
+// Queue returns the queue for the key, sending to it blocks while the queue is full
+func (p *commandPool) Queue(key uint64) chan<- func() {
+	return p.queues[key%uint64(len(p.queues))]
+}
+
+// Stop waits until queued tasks are done, Queue must not be used after Stop
+func (p *commandPool) Stop() {
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.wg.Wait()
+}
+
+// Len returns the number of queued tasks
+func (p *commandPool) Len() (n int) {
+	for _, q := range p.queues {
+		n += len(q)
+	}
+
+	return
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	v5 "github.com/retailcrm/api-client-go/v5"
+	v1 "github.com/retailcrm/mg-bot-api-client-go/v1"
+)
+
+const (
+	productsLimit      = 20
+	inventoriesLimit   = 250
+	productSearchNext  = "next"
+	productSearchTTL   = 30 * time.Minute
+	productSearchIndex = "#"
+)
+
+// productSearch remembers the last product search made in a chat
+type productSearch struct {
+	Query      string
+	Site       string
+	Page       int
+	TotalPages int
+	Products   []v5.Product
+	CreatedAt  time.Time
+}
+
+func (w *Worker) productCommand(loc *i18n.Localizer, chatID uint64, arg, site string) (resMes string, msgProd v1.MessageProduct, err error) {
+	if arg == "" {
+		resMes = loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "set_name_or_article"})
+		return
+	}
+
+	last := w.getProductSearch(chatID)
+
+	if strings.EqualFold(arg, productSearchNext) {
+		if last == nil {
+			resMes = loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "set_name_or_article"})
+			return
+		}
+
+		if last.Page >= last.TotalPages {
+			resMes = loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "no_more_products"})
+			return
+		}
+
+		return w.showProducts(loc, chatID, last.Query, last.Site, last.Page+1)
+	}
+
+	if strings.HasPrefix(arg, productSearchIndex) {
+		if n, er := strconv.Atoi(arg[len(productSearchIndex):]); er == nil {
+			if last == nil || n < 1 || n > len(last.Products) {
+				resMes = loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "product_not_selected"})
+				return
+			}
+
+			return w.productReply(loc, last.Products[n-1], last.Query, last.Site)
+		}
+	}
+
+	return w.showProducts(loc, chatID, arg, site, 1)
+}
+
+func (w *Worker) showProducts(loc *i18n.Localizer, chatID uint64, query, site string, page int) (resMes string, msgProd v1.MessageProduct, err error) {
+	filter := v5.ProductsFilter{
+		Name:   query,
+		Active: 1,
+	}
+
+	if site != "" {
+		filter.Sites = []string{site}
+	}
+
+	observe := crmRequestTimer("Products")
+	res, _, er := w.getCRMClient().Products(v5.ProductsRequest{
+		Filter: filter,
+		Limit:  productsLimit,
+		Page:   page,
+	})
+	observe()
+	err = checkErrors(er)
+	if err != nil {
+		logger.Errorf("%s - Cannot retrieve product, error: %s", w.getCRMClient().URL, err.Error())
+		return
+	}
+
+	if len(res.Products) == 0 {
+		resMes = loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "not_found"})
+		return
+	}
+
+	search := &productSearch{
+		Query:     query,
+		Site:      site,
+		Page:      page,
+		Products:  res.Products,
+		CreatedAt: time.Now(),
+	}
+
+	if res.Pagination != nil {
+		search.TotalPages = res.Pagination.TotalPageCount
+	}
+
+	if len(search.Products) == 1 && search.TotalPages <= 1 {
+		return w.productReply(loc, search.Products[0], query, site)
+	}
+
+	w.setProductSearch(chatID, search)
+	resMes = w.productList(loc, search)
+
+	return
+}
+
+func (w *Worker) productList(loc *i18n.Localizer, search *productSearch) string {
+	s := make([]string, len(search.Products))
+	for k, v := range search.Products {
+		if v.Article != "" {
+			s[k] = fmt.Sprintf("%s (%s)", v.Name, v.Article)
+		} else {
+			s[k] = v.Name
+		}
+	}
+
+	res := fmt.Sprintf(
+		"%s\n\n%s\n\n%s",
+		loc.MustLocalize(&i18n.LocalizeConfig{
+			MessageID: "product_options",
+			TemplateData: map[string]interface{}{
+				"Page":       search.Page,
+				"TotalPages": search.TotalPages,
+			},
+		}),
+		strings.Join(numberedList(s), "\n"),
+		loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "product_select"}),
+	)
+
+	if search.Page < search.TotalPages {
+		res += "\n" + loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "product_next"})
+	}
+
+	return res
+}
+
+// productReply returns the product card of the offer matching the filter
+// followed by the list of all product offers with stock when enabled
+func (w *Worker) productReply(loc *i18n.Localizer, vp v5.Product, filter, site string) (resMes string, msgProd v1.MessageProduct, err error) {
+	currency := w.siteCurrency(site)
+
+	msgProd = w.productMessage(vp, filter, currency)
+	if msgProd.ID == 0 {
+		resMes = loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "not_found"})
+		return
+	}
+
+	conn := w.getConnection()
+	showStock := conn.ShowStock
+	_, custom := conn.getReplyTemplates()[replyProduct]
+	if len(vp.Offers) < 2 && !showStock && len(conn.getPriceTypes()) < 2 && !custom {
+		return
+	}
+
+	var stock map[int][]v5.Inventory
+	if showStock {
+		var er error
+		stock, er = w.offersStock(vp.Offers)
+		if er != nil {
+			logger.Errorf("%s - Cannot retrieve inventories, error: %s", w.getCRMClient().URL, er.Error())
+		}
+	}
+
+	data := productReplyData{
+		Product:  vp,
+		Offer:    searchOffer(vp.Offers, filter),
+		Items:    w.offerItems(vp.Offers, stock),
+		Currency: currency,
+	}
+
+	resMes = w.renderReply(replyProduct, data, func() string {
+		return offersList(loc, data.Items, currency)
+	})
+
+	return
+}
+
+// offerItems returns offers with prices of the enabled price types and stock by stores
+func (w *Worker) offerItems(offers []v5.Offer, stock map[int][]v5.Inventory) []offerReplyItem {
+	var stores map[string]string
+	if len(stock) > 0 {
+		stores, _ = w.stores()
+	}
+
+	priceTypes := w.getConnection().getPriceTypes()
+
+	var priceNames map[string]string
+	if len(priceTypes) > 1 {
+		priceNames = w.priceTypeNames()
+	}
+
+	items := make([]offerReplyItem, len(offers))
+	for k, v := range offers {
+		item := offerReplyItem{
+			Offer:    v,
+			Name:     v.Name,
+			Article:  v.Article,
+			Quantity: v.Quantity,
+		}
+
+		prices := offerPrices(v, priceTypes)
+		for _, pv := range prices {
+			price := offerReplyPrice{Price: pv.Price}
+			if len(prices) > 1 {
+				price.Name = pv.PriceType
+				if n, ok := priceNames[pv.PriceType]; ok {
+					price.Name = n
+				}
+			}
+			item.Prices = append(item.Prices, price)
+		}
+
+		if v.Unit != nil {
+			item.Unit = v.Unit.Sym
+		}
+
+		for _, inv := range stock[v.ID] {
+			name := inv.Store
+			if n, ok := stores[inv.Store]; ok {
+				name = n
+			}
+			item.Stock = append(item.Stock, offerReplyStock{Store: name, Quantity: inv.Quantity})
+		}
+
+		items[k] = item
+	}
+
+	return items
+}
+
+// offersList returns the default list of product offers
+func offersList(loc *i18n.Localizer, items []offerReplyItem, currency string) string {
+	s := make([]string, len(items))
+	for k, v := range items {
+		line := v.Name
+		if v.Article != "" {
+			line += fmt.Sprintf(" (%s)", v.Article)
+		}
+
+		p := make([]string, len(v.Prices))
+		for pk, pv := range v.Prices {
+			p[pk] = fmt.Sprintf("%v %s", pv.Price, currency)
+			if pv.Name != "" {
+				p[pk] = fmt.Sprintf("%s: %s", pv.Name, p[pk])
+			}
+		}
+		line += " — " + strings.Join(p, ", ")
+
+		var unit string
+		if v.Unit != "" {
+			unit = " " + v.Unit
+		}
+		line += fmt.Sprintf(" — %v%s", v.Quantity, unit)
+
+		for _, st := range v.Stock {
+			line += fmt.Sprintf("\n    %s: %v%s", st.Store, st.Quantity, unit)
+		}
+
+		s[k] = line
+	}
+
+	return fmt.Sprintf(
+		"%s\n\n%s",
+		loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "product_offers"}),
+		strings.Join(numberedList(s), "\n"),
+	)
+}
+
+// offersStock returns stock of the offers by stores
+func (w *Worker) offersStock(offers []v5.Offer) (map[int][]v5.Inventory, error) {
+	ids := make([]int, len(offers))
+	for k, v := range offers {
+		ids[k] = v.ID
+	}
+
+	observe := crmRequestTimer("Inventories")
+	res, _, er := w.getCRMClient().Inventories(v5.InventoriesRequest{
+		Filter: v5.InventoriesFilter{
+			Ids:     ids,
+			Details: 1,
+		},
+		Limit: inventoriesLimit,
+	})
+	observe()
+	if err := checkErrors(er); err != nil {
+		return nil, err
+	}
+
+	stock := make(map[int][]v5.Inventory, len(res.Offers))
+	for _, v := range res.Offers {
+		stock[v.ID] = v.Stores
+	}
+
+	return stock, nil
+}
+
+func (w *Worker) productMessage(vp v5.Product, filter, currency string) (msgProd v1.MessageProduct) {
+	if len(vp.Offers) == 0 {
+		return
+	}
+
+	vo := searchOffer(vp.Offers, filter)
+	price := offerPrices(vo, w.getConnection().getPriceTypes())[0]
+
+	msgProd = v1.MessageProduct{
+		ID:      uint64(vo.ID),
+		Name:    vo.Name,
+		Article: vo.Article,
+		Url:     vp.URL,
+		Img:     vp.ImageURL,
+		Cost: &v1.MessageOrderCost{
+			Value:    price.Price,
+			Currency: currency,
+		},
+	}
+
+	if vp.Quantity > 0 {
+		msgProd.Quantity = &v1.MessageOrderQuantity{
+			Value: vp.Quantity,
+		}
+
+		if vo.Unit != nil {
+			msgProd.Quantity.Unit = vo.Unit.Sym
+		}
+	}
+
+	if len(vo.Images) > 0 {
+		msgProd.Img = vo.Images[0]
+	}
+
+	return
+}
+
+// offerPrices returns offer prices of the price types in the given order,
+// the base price is returned when the offer has none of them
+func offerPrices(vo v5.Offer, priceTypes []string) []v5.OfferPrice {
+	var res []v5.OfferPrice
+	for _, code := range priceTypes {
+		for _, p := range vo.Prices {
+			if p.PriceType == code {
+				res = append(res, p)
+				break
+			}
+		}
+	}
+
+	if len(res) == 0 {
+		res = append(res, v5.OfferPrice{Price: vo.Price})
+	}
+
+	return res
+}
+
+func (w *Worker) priceTypeNames() map[string]string {
+	priceTypes, err := w.priceTypes()
+	if err != nil {
+		logger.Errorf("%s - Cannot retrieve price types, error: %s", w.getCRMClient().URL, err.Error())
+	}
+
+	names := make(map[string]string, len(priceTypes))
+	for _, v := range priceTypes {
+		names[v.Code] = v.Name
+	}
+
+	return names
+}
+
+func (w *Worker) getProductSearch(chatID uint64) *productSearch {
+	w.searchMutex.Lock()
+	defer w.searchMutex.Unlock()
+
+	search, ok := w.searches[chatID]
+	if !ok || time.Since(search.CreatedAt) > productSearchTTL {
+		return nil
+	}
+
+	return search
+}
+
+// setProductSearch remembers the last search of the chat, expired searches are swept periodically
+func (w *Worker) setProductSearch(chatID uint64, search *productSearch) {
+	w.searchMutex.Lock()
+	defer w.searchMutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(w.searchesSweep) >= productSearchTTL {
+		for k, v := range w.searches {
+			if now.Sub(v.CreatedAt) > productSearchTTL {
+				delete(w.searches, k)
+			}
+		}
+		w.searchesSweep = now
+	}
+
+	w.searches[chatID] = search
+}
+
+func numberedList(s []string) []string {
+	res := make([]string, len(s))
+	for k, v := range s {
+		var a string
+		for _, iv := range strings.Split(strconv.Itoa(k+1), "") {
+			t, _ := strconv.Atoi(iv)
+			a += emoji[t]
+		}
+		res[k] = fmt.Sprintf("%v %v", a, v)
+	}
+
+	return res
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultChatRate        = 10
+	defaultChatBurst       = 5
+	defaultConnectionRate  = 120
+	defaultConnectionBurst = 30
+
+	rateLimitChat       = "chat"
+	rateLimitConnection = "connection"
+
+	chatBucketTTL = 10 * time.Minute
+)
+
+// tokenBucket allows burst commands at once and refills at rate per second
+type tokenBucket struct {
+	rate     float64
+	burst    float64
+	tokens   float64
+	last     time.Time
+	notified bool
+}
+
+func newTokenBucket(perMinute, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(perMinute) / 60,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// rateLimiter limits commands of a connection and of every chat in it
+type rateLimiter struct {
+	chatRate  int
+	chatBurst int
+
+	mutex      sync.Mutex
+	connection *tokenBucket
+	chats      map[uint64]*tokenBucket
+	lastSweep  time.Time
+}
+
+func newRateLimiter(c RateLimitConfig) *rateLimiter {
+	l := &rateLimiter{
+		chatRate:  c.ChatRate,
+		chatBurst: c.ChatBurst,
+		chats:     map[uint64]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+
+	if l.chatRate <= 0 {
+		l.chatRate = defaultChatRate
+	}
+
+	if l.chatBurst <= 0 {
+		l.chatBurst = defaultChatBurst
+	}
+
+	connRate, connBurst := c.ConnectionRate, c.ConnectionBurst
+	if connRate <= 0 {
+		connRate = defaultConnectionRate
+	}
+
+	if connBurst <= 0 {
+		connBurst = defaultConnectionBurst
+	}
+
+	l.connection = newTokenBucket(connRate, connBurst, time.Now())
+
+	return l
+}
+
+// Allow takes a token from the chat and connection buckets.
+// When the command is rejected, scope names the exhausted bucket and notify
+// is true only for the first rejection in the chat, so the limit reply is not repeated
+func (l *rateLimiter) Allow(chatID uint64) (ok bool, scope string, notify bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	chat, exists := l.chats[chatID]
+	if !exists {
+		chat = newTokenBucket(l.chatRate, l.chatBurst, now)
+		l.chats[chatID] = chat
+	}
+
+	chat.refill(now)
+	l.connection.refill(now)
+
+	switch {
+	case chat.tokens < 1:
+		scope = rateLimitChat
+	case l.connection.tokens < 1:
+		scope = rateLimitConnection
+	default:
+		chat.tokens--
+		l.connection.tokens--
+		chat.notified = false
+		return true, "", false
+	}
+
+	notify = !chat.notified
+	chat.notified = true
+
+	return false, scope, notify
+}
+
+// sweep drops buckets of chats that have been idle long enough to be full again
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < chatBucketTTL {
+		return
+	}
+
+	for k, v := range l.chats {
+		if now.Sub(v.last) > chatBucketTTL {
+			delete(l.chats, k)
+		}
+	}
+	l.lastSweep = now
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReconnectBaseDelay        = 1
+	defaultReconnectMaxDelay         = 300
+	defaultReconnectFailureThreshold = 5
+	defaultReconnectOpenTimeout      = 300
+)
+
+// BreakerState of the websocket reconnect circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed - connection is healthy, failures are retried with backoff
+	BreakerClosed BreakerState = iota
+	// BreakerOpen - too many failures in a row, attempts are suspended for the open timeout
+	BreakerOpen
+	// BreakerHalfOpen - open timeout expired, a single trial attempt is allowed
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// reconnectPolicy implements jittered exponential backoff with a circuit breaker
+type reconnectPolicy struct {
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	openTimeout time.Duration
+	threshold   int
+
+	mutex    sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+}
+
+func newReconnectPolicy(c ReconnectConfig) *reconnectPolicy {
+	p := &reconnectPolicy{
+		baseDelay:   time.Duration(c.BaseDelay) * time.Second,
+		maxDelay:    time.Duration(c.MaxDelay) * time.Second,
+		openTimeout: time.Duration(c.OpenTimeout) * time.Second,
+		threshold:   c.FailureThreshold,
+	}
+
+	if p.baseDelay <= 0 {
+		p.baseDelay = defaultReconnectBaseDelay * time.Second
+	}
+
+	if p.maxDelay <= 0 {
+		p.maxDelay = defaultReconnectMaxDelay * time.Second
+	}
+
+	if p.openTimeout <= 0 {
+		p.openTimeout = defaultReconnectOpenTimeout * time.Second
+	}
+
+	if p.threshold <= 0 {
+		p.threshold = defaultReconnectFailureThreshold
+	}
+
+	return p
+}
+
+// State returns current breaker state
+func (p *reconnectPolicy) State() BreakerState {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.state
+}
+
+// Delay returns how long to wait before the next connection attempt
+func (p *reconnectPolicy) Delay() time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.state == BreakerOpen {
+		return p.openTimeout - time.Since(p.openedAt)
+	}
+
+	if p.failures == 0 {
+		return 0
+	}
+
+	delay := p.maxDelay
+	if p.failures < 32 {
+		if d := p.baseDelay << uint(p.failures-1); d > 0 && d < p.maxDelay {
+			delay = d
+		}
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Attempt must be called right before a connection attempt,
+// it moves an expired open breaker to the half-open state
+func (p *reconnectPolicy) Attempt() (changed bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.state == BreakerOpen && time.Since(p.openedAt) >= p.openTimeout {
+		p.state = BreakerHalfOpen
+		return true
+	}
+
+	return false
+}
+
+// Success resets failures and closes the breaker
+func (p *reconnectPolicy) Success() (changed bool) {
+	return p.Reset()
+}
+
+// Reset forgets failures and closes the breaker, it is used when connection settings change
+func (p *reconnectPolicy) Reset() (changed bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.failures = 0
+	if p.state != BreakerClosed {
+		p.state = BreakerClosed
+		return true
+	}
+
+	return false
+}
+
+// Failure registers a failed attempt and opens the breaker when the threshold is reached
+func (p *reconnectPolicy) Failure() (changed bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.failures++
+
+	if p.state == BreakerHalfOpen || (p.state == BreakerClosed && p.failures >= p.threshold) {
+		p.state = BreakerOpen
+		p.openedAt = time.Now()
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	v5 "github.com/retailcrm/api-client-go/v5"
+)
+
+const defaultReferenceCacheTTL = 300
+
+const (
+	referencePaymentTypes    = "PaymentTypes"
+	referenceDeliveryTypes   = "DeliveryTypes"
+	referenceStatuses        = "Statuses"
+	referencePaymentStatuses = "PaymentStatuses"
+	referenceStores          = "Stores"
+	referencePriceTypes      = "PriceTypes"
+	referenceSites           = "Sites"
+)
+
+// crmPaymentType is a payment type with sites it is available on, v5.PaymentType misses them
+type crmPaymentType struct {
+	v5.PaymentType
+	Sites []string `json:"sites"`
+}
+
+// crmDeliveryType is a delivery type with sites it is available on, v5.DeliveryType misses them
+type crmDeliveryType struct {
+	v5.DeliveryType
+	Sites []string `json:"sites"`
+}
+
+// referenceCache keeps CRM reference data of a connection for the TTL
+type referenceCache struct {
+	ttl time.Duration
+
+	mutex      sync.Mutex
+	entries    map[string]referenceEntry
+	generation uint64
+	hits       uint64
+	misses     uint64
+}
+
+type referenceEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newReferenceCache(ttl int) *referenceCache {
+	if ttl <= 0 {
+		ttl = defaultReferenceCacheTTL
+	}
+
+	return &referenceCache{
+		ttl:     time.Duration(ttl) * time.Second,
+		entries: map[string]referenceEntry{},
+	}
+}
+
+// get returns cached reference or loads and caches it,
+// data loaded before an invalidation is returned but not cached
+func (c *referenceCache) get(name string, load func() (interface{}, error)) (interface{}, error) {
+	c.mutex.Lock()
+	if e, ok := c.entries[name]; ok && time.Now().Before(e.expires) {
+		c.hits++
+		c.mutex.Unlock()
+		referenceCacheTotal.WithLabelValues(name, "hit").Inc()
+		return e.value, nil
+	}
+	c.misses++
+	generation := c.generation
+	c.mutex.Unlock()
+	referenceCacheTotal.WithLabelValues(name, "miss").Inc()
+
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if generation == c.generation {
+		c.entries[name] = referenceEntry{value: value, expires: time.Now().Add(c.ttl)}
+	}
+
+	return value, nil
+}
+
+// invalidate drops all cached references
+func (c *referenceCache) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries = map[string]referenceEntry{}
+	c.generation++
+}
+
+func (c *referenceCache) stats() (hits, misses uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.hits, c.misses
+}
+
+// getReference loads CRM reference by the path into res,
+// it is used for data the v5 client types miss
+func getReference(client *v5.Client, path string, res interface{}) error {
+	data, status, er := client.GetRequest(path)
+	if err := checkErrors(er); err != nil {
+		return err
+	}
+
+	var r struct {
+		Success bool `json:"success"`
+	}
+
+	if err := json.Unmarshal(data, &r); err != nil {
+		return err
+	}
+
+	if !r.Success {
+		return fmt.Errorf("cannot retrieve %s, status code: %d", path, status)
+	}
+
+	return json.Unmarshal(data, res)
+}
+
+// availableOnSite checks the site is in sites, an empty site or sites list means any site
+func availableOnSite(sites []string, site string) bool {
+	if site == "" || len(sites) == 0 {
+		return true
+	}
+
+	for _, v := range sites {
+		if v == site {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (w *Worker) paymentTypes() (map[string]crmPaymentType, error) {
+	res, err := w.references.get(referencePaymentTypes, func() (interface{}, error) {
+		observe := crmRequestTimer(referencePaymentTypes)
+		defer observe()
+
+		var res struct {
+			PaymentTypes map[string]crmPaymentType `json:"paymentTypes"`
+		}
+
+		if err := getReference(w.getCRMClient(), "/reference/payment-types", &res); err != nil {
+			return nil, err
+		}
+
+		return res.PaymentTypes, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.(map[string]crmPaymentType), nil
+}
+
+func (w *Worker) deliveryTypes() (map[string]crmDeliveryType, error) {
+	res, err := w.references.get(referenceDeliveryTypes, func() (interface{}, error) {
+		observe := crmRequestTimer(referenceDeliveryTypes)
+		defer observe()
+
+		var res struct {
+			DeliveryTypes map[string]crmDeliveryType `json:"deliveryTypes"`
+		}
+
+		if err := getReference(w.getCRMClient(), "/reference/delivery-types", &res); err != nil {
+			return nil, err
+		}
+
+		return res.DeliveryTypes, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.(map[string]crmDeliveryType), nil
+}
+
+func (w *Worker) statuses() (map[string]v5.Status, error) {
+	res, err := w.references.get(referenceStatuses, func() (interface{}, error) {
+		observe := crmRequestTimer(referenceStatuses)
+		res, _, er := w.getCRMClient().Statuses()
+		observe()
+		if err := checkErrors(er); err != nil {
+			return nil, err
+		}
+
+		return res.Statuses, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.(map[string]v5.Status), nil
+}
+
+func (w *Worker) paymentStatuses() (map[string]v5.PaymentStatus, error) {
+	res, err := w.references.get(referencePaymentStatuses, func() (interface{}, error) {
+		observe := crmRequestTimer(referencePaymentStatuses)
+		res, _, er := w.getCRMClient().PaymentStatuses()
+		observe()
+		if err := checkErrors(er); err != nil {
+			return nil, err
+		}
+
+		return res.PaymentStatuses, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.(map[string]v5.PaymentStatus), nil
+}
+
+// stores returns store names by codes
+func (w *Worker) stores() (map[string]string, error) {
+	res, err := w.references.get(referenceStores, func() (interface{}, error) {
+		observe := crmRequestTimer(referenceStores)
+		res, _, er := w.getCRMClient().Stores()
+		observe()
+		if err := checkErrors(er); err != nil {
+			return nil, err
+		}
+
+		stores := make(map[string]string, len(res.Stores))
+		for _, v := range res.Stores {
+			stores[v.Code] = v.Name
+		}
+
+		return stores, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.(map[string]string), nil
+}
+
+// getPriceTypes returns active CRM price types
+func getPriceTypes(client *v5.Client) ([]v5.PriceType, error) {
+	res, _, er := client.PriceTypes()
+	if err := checkErrors(er); err != nil {
+		return nil, err
+	}
+
+	var priceTypes []v5.PriceType
+	for _, v := range res.PriceTypes {
+		if v.Active {
+			priceTypes = append(priceTypes, v)
+		}
+	}
+
+	return priceTypes, nil
+}
+
+// priceTypes returns active price types
+func (w *Worker) priceTypes() ([]v5.PriceType, error) {
+	res, err := w.references.get(referencePriceTypes, func() (interface{}, error) {
+		observe := crmRequestTimer(referencePriceTypes)
+		defer observe()
+
+		return getPriceTypes(w.getCRMClient())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.([]v5.PriceType), nil
+}
+
+// sites returns sites with currencies by codes
+func (w *Worker) sites() (map[string]crmSite, error) {
+	res, err := w.references.get(referenceSites, func() (interface{}, error) {
+		observe := crmRequestTimer(referenceSites)
+		defer observe()
+
+		return getSites(w.getCRMClient())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.(map[string]crmSite), nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	v5 "github.com/retailcrm/api-client-go/v5"
+)
+
+const (
+	replyPayment  = "payment"
+	replyDelivery = "delivery"
+	replyProduct  = "product"
+	replyOrder    = "order"
+)
+
+// replyTemplates are bot replies a connection can override with text/template templates,
+// sample data is used to validate templates and to preview them on the settings page
+var replyTemplates = []replyTemplate{
+	{
+		Name:   replyPayment,
+		Title:  "reply_payment",
+		Fields: "reply_list_fields",
+		Sample: listReplyData{Items: []string{"Cash", "Bank card"}},
+	},
+	{
+		Name:   replyDelivery,
+		Title:  "reply_delivery",
+		Fields: "reply_list_fields",
+		Sample: listReplyData{Items: []string{"Courier", "Pickup"}},
+	},
+	{
+		Name:   replyProduct,
+		Title:  "reply_product",
+		Fields: "reply_product_fields",
+		Sample: sampleProductReply(),
+	},
+	{
+		Name:   replyOrder,
+		Title:  "reply_order",
+		Fields: "reply_order_fields",
+		Sample: orderReplyData{
+			Number:   "1234A",
+			Status:   "New",
+			Delivery: "Courier",
+			Payment:  "Paid",
+			Total:    1500,
+			Currency: defaultCurrency,
+		},
+	},
+}
+
+// templateOutputLimit is the size of rendered reply, event and auto answer templates,
+// templates are written by users so the output must not grow without bounds
+const templateOutputLimit = 4096
+
+var (
+	errTemplateOutputLimit = fmt.Errorf("template output exceeds %d bytes", templateOutputLimit)
+	errTemplateFormatWidth = errors.New("printf widths and precisions over 999 are not allowed")
+	templateFormatWidth    = regexp.MustCompile(`%[^a-zA-Z%]*(\*|\d{4,})`)
+)
+
+// limitedFuncs replace template builtins able to allocate unbounded output
+var limitedFuncs = template.FuncMap{
+	"printf": limitedSprintf,
+}
+
+// replyFuncs are functions available in reply templates
+var replyFuncs = template.FuncMap{
+	"number": numberEmoji,
+	"inc": func(n int) int {
+		return n + 1
+	},
+	"join":   strings.Join,
+	"printf": limitedSprintf,
+}
+
+// limitedWriter fails writes past the limit, so execution stops at the first one
+type limitedWriter struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > w.limit {
+		return 0, errTemplateOutputLimit
+	}
+
+	return w.buf.Write(p)
+}
+
+// limitedSprintf is printf without widths and precisions allocating large strings
+func limitedSprintf(format string, args ...interface{}) (string, error) {
+	if templateFormatWidth.MatchString(format) {
+		return "", errTemplateFormatWidth
+	}
+
+	return fmt.Sprintf(format, args...), nil
+}
+
+// executeTemplate executes the template with the data limiting the output size
+func executeTemplate(tmpl *template.Template, data interface{}) (string, error) {
+	w := &limitedWriter{limit: templateOutputLimit}
+	if err := tmpl.Execute(w, data); err != nil {
+		return "", err
+	}
+
+	return w.buf.String(), nil
+}
+
+type replyTemplate struct {
+	Name string
+	// Title is the message ID of the template title on the settings page
+	Title string
+	// Fields is the message ID of the template data description
+	Fields string
+	Sample interface{}
+}
+
+// listReplyData is passed to payment and delivery reply templates
+type listReplyData struct {
+	Items []string
+}
+
+// productReplyData is passed to product reply templates
+type productReplyData struct {
+	Product v5.Product
+	// Offer is the offer shown in the product card
+	Offer    v5.Offer
+	Items    []offerReplyItem
+	Currency string
+}
+
+type offerReplyItem struct {
+	Offer    v5.Offer
+	Name     string
+	Article  string
+	Prices   []offerReplyPrice
+	Quantity float32
+	Unit     string
+	Stock    []offerReplyStock
+}
+
+type offerReplyPrice struct {
+	// Name is the price type name, it is empty when only one price is shown
+	Name  string
+	Price float32
+}
+
+type offerReplyStock struct {
+	Store    string
+	Quantity float32
+}
+
+// orderReplyData is passed to order reply templates
+type orderReplyData struct {
+	Order    v5.Order
+	Number   string
+	Status   string
+	Delivery string
+	Payment  string
+	Total    float32
+	Currency string
+}
+
+func sampleProductReply() productReplyData {
+	offer := v5.Offer{ID: 1, Name: "T-shirt, red, M", Article: "TS-RM", Price: 990, Quantity: 12}
+
+	return productReplyData{
+		Product: v5.Product{ID: 1, Name: "T-shirt", Offers: []v5.Offer{offer}},
+		Offer:   offer,
+		Items: []offerReplyItem{
+			{
+				Offer:    offer,
+				Name:     offer.Name,
+				Article:  offer.Article,
+				Prices:   []offerReplyPrice{{Price: offer.Price}},
+				Quantity: offer.Quantity,
+				Unit:     "pcs",
+				Stock:    []offerReplyStock{{Store: "Main store", Quantity: 12}},
+			},
+		},
+		Currency: defaultCurrency,
+	}
+}
+
+// getReplyTemplate returns the reply template by the name
+func getReplyTemplate(name string) (replyTemplate, bool) {
+	for _, v := range replyTemplates {
+		if v.Name == name {
+			return v, true
+		}
+	}
+
+	return replyTemplate{}, false
+}
+
+// renderReplyTemplate executes the reply template text with the data
+func renderReplyTemplate(text string, data interface{}) (string, error) {
+	tmpl, err := template.New("reply").Funcs(replyFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	return executeTemplate(tmpl, data)
+}
+
+// previewReplyTemplate renders the template with the sample data of the reply
+func previewReplyTemplate(name, text string) (string, error) {
+	t, ok := getReplyTemplate(name)
+	if !ok {
+		return "", fmt.Errorf("unknown reply %s", name)
+	}
+
+	return renderReplyTemplate(text, t.Sample)
+}
+
+// validateReplyTemplates renders every template with the sample data of its reply
+func validateReplyTemplates(templates map[string]string) error {
+	for name, text := range templates {
+		if text == "" {
+			continue
+		}
+
+		if _, err := previewReplyTemplate(name, text); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// renderReply renders the reply template of the connection,
+// the default reply is used when the template is not set or fails
+func (w *Worker) renderReply(name string, data interface{}, def func() string) string {
+	text := w.getConnection().getReplyTemplates()[name]
+	if text == "" {
+		return def()
+	}
+
+	res, err := renderReplyTemplate(text, data)
+	if err != nil {
+		w.logger.Warningf("%s - Cannot execute %s reply template, error: %v", w.getConnection().APIURL, name, err)
+		return def()
+	}
+
+	return res
+}
+
+// numberEmoji returns the number written with emoji digits
+func numberEmoji(n int) string {
+	var res string
+	for _, v := range strconv.Itoa(n) {
+		res += emoji[v-'0']
+	}
+
+	return strings.TrimSpace(res)
+}
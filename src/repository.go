@@ -31,6 +31,10 @@ func (c *Connection) setConnectionActivity() error {
 	return orm.DB.Model(c).Where("client_id = ?", c.ClientID).Updates(map[string]interface{}{"active": c.Active, "api_url": c.APIURL}).Error
 }
 
+func (c *Connection) setShowStock() error {
+	return orm.DB.Model(c).Where("client_id = ?", c.ClientID).Update("show_stock", c.ShowStock).Error
+}
+
 func (c *Connection) createConnection() error {
 	return orm.DB.Create(c).Error
 }
@@ -4,12 +4,41 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
 	"github.com/retailcrm/api-client-go/v5"
+	"github.com/retailcrm/mg-bot-api-client-go/v1"
 )
 
+type commandSetting struct {
+	Name        string
+	Description string
+	Enabled     bool
+}
+
+type priceTypeSetting struct {
+	Code    string
+	Name    string
+	Enabled bool
+}
+
+type channelSetting struct {
+	ID   string
+	Name string
+	Site string
+}
+
+type replySetting struct {
+	Name     string
+	Title    string
+	Fields   string
+	Template string
+}
+
 func connectHandler(c *gin.Context) {
 	res := struct {
 		Conn   Connection
@@ -25,18 +54,93 @@ func connectHandler(c *gin.Context) {
 }
 
 func botSettingsHandler(c *gin.Context) {
-	jm := map[string]string{}
+	var req struct {
+		ClientID   string            `json:"client_id"`
+		Lang       string            `json:"lang"`
+		Currency   string            `json:"currency"`
+		Commands   []string          `json:"commands"`
+		ShowStock  bool              `json:"show_stock"`
+		PriceTypes *[]string         `json:"price_types"`
+		Sites      map[string]string `json:"channel_sites"`
+		Answers    autoAnswers       `json:"auto_answers"`
+		Events     eventSettings     `json:"events"`
+		Replies    map[string]string `json:"replies"`
+	}
 
-	if err := c.ShouldBindJSON(&jm); err != nil {
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.Error(err)
 		return
 	}
 
-	conn := getConnection(jm["client_id"])
-	conn.Lang = jm["lang"]
-	conn.Currency = jm["currency"]
+	conn := getConnection(req.ClientID)
+	if conn.ID == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": getLocalizedMessage("wrong_data")})
+		return
+	}
+
+	if _, err := compileAutoAnswers(req.Answers.Rules); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID:    "invalid_auto_answer",
+			TemplateData: map[string]interface{}{"Error": err.Error()},
+		})})
+		return
+	}
+
+	if err := req.Events.validate(); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID:    "invalid_event_message",
+			TemplateData: map[string]interface{}{"Error": err.Error()},
+		})})
+		return
+	}
+
+	if err := validateReplyTemplates(req.Replies); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": localizer.MustLocalize(&i18n.LocalizeConfig{
+			MessageID:    "invalid_reply_template",
+			TemplateData: map[string]interface{}{"Error": err.Error()},
+		})})
+		return
+	}
+
+	conn.Lang = req.Lang
+	conn.Currency = req.Currency
+	conn.setCommands(req.Commands)
+	conn.ShowStock = req.ShowStock
+	// price types are not sent when the form could not show them
+	if req.PriceTypes != nil {
+		conn.setPriceTypes(*req.PriceTypes)
+	}
+	// channel sites are not sent when the form could not show channels
+	if req.Sites != nil {
+		conn.setChannelSites(req.Sites)
+	}
+	conn.setAutoAnswers(req.Answers)
+	conn.setEventSettings(req.Events)
+	conn.setReplyTemplates(req.Replies)
+
+	if _, err, code := getAPIClient(conn.APIURL, conn.APIKEY, conn.getCommands()); err != nil {
+		if code == http.StatusInternalServerError {
+			c.Error(err)
+		} else {
+			c.JSON(code, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	code, err := SetBotCommand(conn.MGURL, conn.MGToken, conn.getCommands(), getLang(conn.Lang))
+	if err != nil {
+		c.JSON(code, gin.H{"error": getLocalizedMessage("error_activity_mg")})
+		logger.Error(conn.APIURL, code, err)
+		return
+	}
 
-	err := conn.saveConnection()
+	err = conn.saveConnection()
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	err = conn.setShowStock()
 	if err != nil {
 		c.Error(err)
 		return
@@ -55,27 +159,153 @@ func settingsHandler(c *gin.Context) {
 		return
 	}
 
+	commands := make([]commandSetting, len(botCommands.all()))
+	for k, v := range botCommands.all() {
+		commands[k] = commandSetting{
+			Name:        v.Name(),
+			Description: getLocalizedMessage(v.Description()),
+			Enabled:     p.isCommandEnabled(v.Name()),
+		}
+	}
+
+	templates := p.getReplyTemplates()
+	replies := make([]replySetting, len(replyTemplates))
+	for k, v := range replyTemplates {
+		replies[k] = replySetting{
+			Name:     v.Name,
+			Title:    getLocalizedMessage(v.Title),
+			Fields:   getLocalizedMessage(v.Fields),
+			Template: templates[v.Name],
+		}
+	}
+
+	var (
+		priceTypes []priceTypeSetting
+		channels   []channelSetting
+		sites      []crmSite
+	)
+
+	client := v5.New(p.APIURL, p.APIKEY)
+
+	types, err := getPriceTypes(client)
+	if err != nil {
+		logger.Error(p.APIURL, "cannot retrieve price types:", err)
+	}
+
+	for _, v := range types {
+		priceTypes = append(priceTypes, priceTypeSetting{
+			Code:    v.Code,
+			Name:    v.Name,
+			Enabled: p.isPriceTypeEnabled(v.Code),
+		})
+	}
+
+	channels, sites = channelSettings(client, p)
+
 	res := struct {
 		Conn         *Connection
 		Locale       map[string]interface{}
 		Year         int
 		LangCode     []string
 		CurrencyCode map[string]string
+		Commands     []commandSetting
+		PriceTypes   []priceTypeSetting
+		Channels     []channelSetting
+		Sites        []crmSite
+		Answers      autoAnswers
+		Events       eventSettings
+		Replies      []replySetting
 	}{
 		p,
 		getLocale(),
 		time.Now().Year(),
 		[]string{"en", "ru", "es"},
-		currency,
+		currencyOptions(p.Currency),
+		commands,
+		priceTypes,
+		channels,
+		sites,
+		p.getAutoAnswers(),
+		p.getEventSettings(),
+		replies,
 	}
 
 	c.HTML(200, "form", res)
 }
 
+// replyPreviewHandler renders the reply template with sample data for the settings page
+func replyPreviewHandler(c *gin.Context) {
+	var req struct {
+		ClientID string `json:"client_id"`
+		Name     string `json:"name"`
+		Template string `json:"template"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": getLocalizedMessage("wrong_data")})
+		return
+	}
+
+	if req.ClientID == "" || getConnection(req.ClientID).ID == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": getLocalizedMessage("wrong_data")})
+		return
+	}
+
+	res, err := previewReplyTemplate(req.Name, req.Template)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"preview": res})
+}
+
+// channelSettings returns active MG channels with their CRM sites and the sites list,
+// channels are not shown for single site accounts
+func channelSettings(client *v5.Client, p *Connection) ([]channelSetting, []crmSite) {
+	res, err := getSites(client)
+	if err != nil {
+		logger.Error(p.APIURL, "cannot retrieve sites:", err)
+		return nil, nil
+	}
+
+	if len(res) < 2 {
+		return nil, nil
+	}
+
+	sites := make([]crmSite, 0, len(res))
+	for _, v := range res {
+		sites = append(sites, v)
+	}
+	sort.Slice(sites, func(i, j int) bool {
+		return sites[i].Code < sites[j].Code
+	})
+
+	data, _, err := v1.New(p.MGURL, p.MGToken).Channels(v1.ChannelsRequest{Active: 1})
+	if err != nil {
+		logger.Error(p.APIURL, "cannot retrieve channels:", err)
+		return nil, nil
+	}
+
+	channelSites := p.getChannelSites()
+	channels := make([]channelSetting, len(data))
+	for k, v := range data {
+		id := strconv.FormatUint(v.ID, 10)
+		channels[k] = channelSetting{
+			ID:   id,
+			Name: v.Name,
+			Site: channelSites[id],
+		}
+	}
+
+	return channels, sites
+}
+
 func saveHandler(c *gin.Context) {
 	conn := c.MustGet("connection").(Connection)
 
-	_, err, code := getAPIClient(conn.APIURL, conn.APIKEY)
+	// the request has only credentials, commands are checked as they are enabled
+	_, err, code := getAPIClient(conn.APIURL, conn.APIKEY, getConnection(conn.ClientID).getCommands())
 	if err != nil {
 		if code == http.StatusInternalServerError {
 			c.Error(err)
@@ -91,7 +321,8 @@ func saveHandler(c *gin.Context) {
 		return
 	}
 
-	wm.setWorker(&conn)
+	// the request has only credentials, the worker needs the whole connection
+	wm.setWorker(getConnection(conn.ClientID))
 
 	c.JSON(http.StatusOK, gin.H{"msg": getLocalizedMessage("successful")})
 }
@@ -105,7 +336,7 @@ func createHandler(c *gin.Context) {
 		return
 	}
 
-	client, err, code := getAPIClient(conn.APIURL, conn.APIKEY)
+	client, err, code := getAPIClient(conn.APIURL, conn.APIKEY, botCommands.names())
 	if err != nil {
 		if code == http.StatusInternalServerError {
 			c.Error(err)
@@ -133,12 +364,16 @@ func createHandler(c *gin.Context) {
 	conn.MGToken = data.Info.MgBotInfo.Token
 	conn.Active = true
 	conn.Lang = "ru"
-	conn.Currency = currency["Российский рубль"]
+	conn.Currency = defaultCurrency
+	if sites, err := getSites(client); err != nil {
+		logger.Error(conn.APIURL, "cannot retrieve sites:", err)
+	} else {
+		conn.Currency = sitesCurrency(sites)
+	}
 
-	bj, _ := json.Marshal(botCommands)
-	conn.Commands.RawMessage = bj
+	conn.setCommands(botCommands.names())
 
-	code, err = SetBotCommand(conn.MGURL, conn.MGToken)
+	code, err = SetBotCommand(conn.MGURL, conn.MGToken, conn.getCommands(), getLang(conn.Lang))
 	if err != nil {
 		c.JSON(code, gin.H{"error": getLocalizedMessage("error_activity_mg")})
 		logger.Error(conn.APIURL, code, err)
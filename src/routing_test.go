@@ -63,6 +63,22 @@ func TestRouting_connectHandler(t *testing.T) {
 }
 
 func TestRouting_settingsHandler(t *testing.T) {
+	defer gock.Off()
+
+	conn := getConnection(clientID)
+	gock.New(conn.APIURL).
+		Get("/api/v5/reference/price-types").
+		Reply(200).
+		BodyString(`{"success": true, "priceTypes": [{"code": "base", "name": "Base", "active": true, "default": true}]}`)
+	gock.New(conn.APIURL).
+		Get("/api/v5/reference/sites").
+		Reply(200).
+		BodyString(`{"success": true, "sites": {"shop": {"code": "shop", "name": "Shop"}, "outlet": {"code": "outlet", "name": "Outlet"}}}`)
+	gock.New(conn.MGURL).
+		Get("/api/bot/v1/channels").
+		Reply(200).
+		BodyString(`[{"id": 7, "name": "Shop Telegram", "type": "telegram"}]`)
+
 	req, err := http.NewRequest("GET", "/settings/"+clientID, nil)
 	if err != nil {
 		t.Fatal(err)
@@ -73,6 +89,8 @@ func TestRouting_settingsHandler(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, rr.Code,
 		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK))
+	assert.Contains(t, rr.Body.String(), "Shop Telegram")
+	assert.True(t, gock.IsDone())
 }
 
 func TestRouting_saveHandler(t *testing.T) {
@@ -81,7 +99,7 @@ func TestRouting_saveHandler(t *testing.T) {
 	gock.New(crmUrl).
 		Get("/api/credentials").
 		Reply(200).
-		BodyString(`{"success": true, "credentials": ["/api/integration-modules/{code}", "/api/integration-modules/{code}/edit", "/api/reference/payment-types", "/api/reference/delivery-types", "/api/store/products"]}`)
+		BodyString(`{"success": true, "credentials": ["/api/integration-modules/{code}", "/api/integration-modules/{code}/edit", "/api/reference/payment-types", "/api/reference/delivery-types", "/api/store/products", "/api/orders", "/api/reference/statuses", "/api/reference/payment-statuses", "/api/store/inventories", "/api/reference/stores", "/api/reference/price-types", "/api/reference/sites"]}`)
 
 	req, err := http.NewRequest("POST", "/save/",
 		strings.NewReader(fmt.Sprintf(
@@ -101,12 +119,17 @@ func TestRouting_saveHandler(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, rr.Code,
 		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK))
+
+	if w, ok := wm.getWorker(clientID); assert.True(t, ok) {
+		assert.Equal(t, "test", w.getConnection().APIKEY)
+		assert.Equal(t, "https://test.retailcrm.pro", w.getConnection().MGURL)
+	}
 }
 
 func TestRouting_activityHandler(t *testing.T) {
 	startWS()
 
-	if _, ok := wm.workers[clientID]; !ok {
+	if _, ok := wm.getWorker(clientID); !ok {
 		t.Fatal("worker don`t start")
 	}
 
@@ -149,18 +172,204 @@ func TestRouting_activityHandler(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		w, ok := wm.workers[clientID]
+		w, ok := wm.getWorker(clientID)
 
 		if ok != (activity["active"] && !activity["freeze"]) {
 			t.Error("worker don`t stop")
 		}
 
-		if ok && w.connection.APIURL != v.Get("systemUrl") {
+		if ok && w.getConnection().APIURL != v.Get("systemUrl") {
 			t.Error("fail update systemUrl")
 		}
 	}
 }
 
+func TestRouting_adminWorkersHandler(t *testing.T) {
+	config.Admin.Token = "admin-token"
+	defer func() { config.Admin.Token = "" }()
+
+	startWS()
+
+	req, err := http.NewRequest("GET", "/admin/workers", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code,
+		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized))
+
+	req.Header.Set("X-Admin-Token", "admin-token")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code,
+		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK))
+
+	var res struct {
+		Workers []WorkerInfo `json:"workers"`
+	}
+	err = json.Unmarshal(rr.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.Len(t, res.Workers, 1) {
+		assert.Equal(t, clientID, res.Workers[0].ClientID)
+	}
+}
+
+func TestRouting_botSettingsHandler(t *testing.T) {
+	defer gock.Off()
+
+	gock.New("https://test.retailcrm.pro").
+		Put("/api/bot/v1/my/commands/").
+		Persist().
+		Reply(200).
+		BodyString(`{}`)
+	gock.New("https://test.retailcrm.pro").
+		Delete("/api/bot/v1/my/commands/").
+		Persist().
+		Reply(200).
+		BodyString(`{}`)
+
+	conn := getConnection(clientID)
+	gock.New(conn.APIURL).
+		Get("/api/credentials").
+		Persist().
+		Reply(200).
+		BodyString(`{"success": true, "credentials": ["/api/integration-modules/{code}", "/api/integration-modules/{code}/edit", "/api/reference/sites", "/api/reference/payment-types"]}`)
+
+	conn.setPriceTypes([]string{"wholesale"})
+	conn.setChannelSites(map[string]string{"1": "shop"})
+	if err := conn.saveConnection(); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(body string, code int) {
+		req, err := http.NewRequest("POST", "/bot-settings/", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		assert.Equal(t, code, rr.Code,
+			fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, code))
+	}
+
+	send(fmt.Sprintf(`{"client_id": "%s", "lang": "en", "currency": "rub", "commands": ["/payment", "/order"], "price_types": null, "channel_sites": null}`, clientID), http.StatusBadRequest)
+
+	send(fmt.Sprintf(`{"client_id": "%s", "lang": "en", "currency": "rub", "commands": ["/payment"], "price_types": null, "channel_sites": null}`, clientID), http.StatusOK)
+	assert.Equal(t, []string{"wholesale"}, getConnection(clientID).getPriceTypes())
+	assert.Equal(t, map[string]string{"1": "shop"}, getConnection(clientID).getChannelSites())
+
+	send(fmt.Sprintf(`{"client_id": "%s", "lang": "en", "currency": "rub", "commands": ["/payment"], "price_types": [], "channel_sites": {}}`, clientID), http.StatusOK)
+	assert.Empty(t, getConnection(clientID).getPriceTypes())
+	assert.Empty(t, getConnection(clientID).getChannelSites())
+}
+
+func TestRouting_metricsHandler(t *testing.T) {
+	req, err := http.NewRequest("GET", "/health", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	req, err = http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code,
+		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK))
+	assert.Contains(t, rr.Body.String(), "# TYPE mg_bot_active_workers gauge")
+	assert.Contains(t, rr.Body.String(), `mg_bot_http_request_duration_seconds_count{method="GET",path="/health",status="200"}`)
+}
+
+func TestRouting_replyPreviewHandler(t *testing.T) {
+	body := `{"name": "order", "template": "{{.Number}}"}`
+	req, err := http.NewRequest("POST", "/reply-preview/", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code,
+		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest))
+
+	body = fmt.Sprintf(`{"client_id": "%s", "name": "order", "template": "{{.Number}}: {{.Status}}"}`, clientID)
+	req, err = http.NewRequest("POST", "/reply-preview/", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code,
+		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK))
+	assert.Contains(t, rr.Body.String(), "1234A: New")
+
+	body = fmt.Sprintf(`{"client_id": "%s", "name": "order", "template": "{{.Unknown}}"}`, clientID)
+	req, err = http.NewRequest("POST", "/reply-preview/", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code,
+		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest))
+}
+
+func TestRouting_healthHandler(t *testing.T) {
+	req, err := http.NewRequest("GET", "/health", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code,
+		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK))
+}
+
+func TestRouting_readyHandler(t *testing.T) {
+	req, err := http.NewRequest("GET", "/ready", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code,
+		fmt.Sprintf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK))
+
+	var res struct {
+		Status string `json:"status"`
+	}
+	err = json.Unmarshal(rr.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "ok", res.Status)
+}
+
 func TestTranslate(t *testing.T) {
 	files, err := ioutil.ReadDir("translate")
 	if err != nil {
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/getsentry/raven-go"
 	"github.com/gin-contrib/multitemplate"
 	"github.com/gin-gonic/gin"
 	_ "github.com/golang-migrate/migrate/database/postgres"
 	_ "github.com/golang-migrate/migrate/source/file"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func init() {
@@ -21,6 +25,8 @@ func init() {
 	)
 }
 
+const defaultShutdownTimeout = 10 * time.Second
+
 var (
 	sentry *raven.Client
 	wm     = NewWorkersManager()
@@ -35,14 +41,19 @@ func (x *RunCommand) Execute(args []string) error {
 	orm = NewDb(config)
 	logger = newLogger()
 
-	go start()
+	srv := &http.Server{
+		Addr:    config.HTTPServer.Listen,
+		Handler: setup(),
+	}
+
+	go start(srv)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c)
 	for sig := range c {
 		switch sig {
 		case os.Interrupt, syscall.SIGQUIT, syscall.SIGTERM:
-			orm.DB.Close()
+			shutdown(srv)
 			return nil
 		default:
 		}
@@ -51,10 +62,31 @@ func (x *RunCommand) Execute(args []string) error {
 	return nil
 }
 
-func start() {
-	router := setup()
+func start(srv *http.Server) {
 	startWS()
-	router.Run(config.HTTPServer.Listen)
+
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Fatal(err)
+	}
+}
+
+// shutdown stops HTTP server and workers, then closes database connection
+func shutdown(srv *http.Server) {
+	timeout := time.Duration(config.ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	// the server and workers share the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Error("http server shutdown:", err)
+	}
+
+	wm.Shutdown(ctx)
+	orm.DB.Close()
 }
 
 func setup() *gin.Engine {
@@ -67,6 +99,7 @@ func setup() *gin.Engine {
 
 	r := gin.New()
 	r.Use(gin.Recovery())
+	r.Use(metricsMiddleware(r))
 	if config.Debug {
 		r.Use(gin.Logger())
 	}
@@ -96,7 +129,17 @@ func setup() *gin.Engine {
 	r.POST("/save/", checkConnectionForRequest(), saveHandler)
 	r.POST("/create/", checkConnectionForRequest(), createHandler)
 	r.POST("/bot-settings/", botSettingsHandler)
+	r.POST("/reply-preview/", replyPreviewHandler)
 	r.POST("/actions/activity", activityHandler)
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.GET("/health", healthHandler)
+	r.GET("/ready", readyHandler)
+
+	admin := r.Group("/admin", checkAdminToken())
+	admin.GET("/workers", adminWorkersHandler)
+	admin.GET("/workers/:uid", adminWorkerHandler)
+	admin.POST("/workers/:uid/restart", adminRestartWorkerHandler)
+	admin.POST("/workers/:uid/stop", adminStopWorkerHandler)
 
 	return r
 }
@@ -133,6 +176,17 @@ func checkConnectionForRequest() gin.HandlerFunc {
 	}
 }
 
+func checkAdminToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.GetHeader("X-Admin-Token")
+		if config.Admin.Token == "" ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(config.Admin.Token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+	}
+}
+
 func startWS() {
 	res := getActiveConnection()
 	if len(res) > 0 {
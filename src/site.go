@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	v1 "github.com/retailcrm/mg-bot-api-client-go/v1"
+)
+
+// chatChannelTTL is the time channels of chats are cached, channels of chats never change
+// so the TTL only bounds the cache
+const chatChannelTTL = 24 * time.Hour
+
+// chatChannel is the cached MG channel of a chat
+type chatChannel struct {
+	ID        uint64
+	CreatedAt time.Time
+}
+
+// chatChannel returns the MG channel of the chat
+func (w *Worker) chatChannel(chatID uint64) (uint64, error) {
+	w.channelMutex.Lock()
+	channel, ok := w.channels[chatID]
+	w.channelMutex.Unlock()
+	if ok && time.Since(channel.CreatedAt) <= chatChannelTTL {
+		return channel.ID, nil
+	}
+
+	chats, _, err := w.getMGClient().Chats(v1.ChatsRequest{ID: chatID})
+	if err != nil {
+		return 0, err
+	}
+
+	var channelID uint64
+	if len(chats) > 0 {
+		channelID = chats[0].Channel.ID
+	}
+
+	w.setChatChannel(chatID, channelID)
+
+	return channelID, nil
+}
+
+func (w *Worker) setChatChannel(chatID, channelID uint64) {
+	w.channelMutex.Lock()
+	defer w.channelMutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(w.channelsSweep) >= chatChannelTTL {
+		for k, v := range w.channels {
+			if now.Sub(v.CreatedAt) > chatChannelTTL {
+				delete(w.channels, k)
+			}
+		}
+		w.channelsSweep = now
+	}
+
+	w.channels[chatID] = chatChannel{ID: channelID, CreatedAt: now}
+}
+
+// chatSite returns the CRM site mapped to the channel of the chat,
+// an empty site means the chat is not bound to a site
+func (w *Worker) chatSite(chatID uint64) string {
+	sites := w.getConnection().getChannelSites()
+	if len(sites) == 0 {
+		return ""
+	}
+
+	channelID, err := w.chatChannel(chatID)
+	if err != nil {
+		logger.Errorf("%s - Cannot retrieve chat %d, error: %s", w.getConnection().APIURL, chatID, err.Error())
+		return ""
+	}
+
+	return sites[strconv.FormatUint(channelID, 10)]
+}
@@ -20,7 +20,8 @@ func GenerateToken() string {
 	return fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%d%d", time.Now().UnixNano(), c))))
 }
 
-func getAPIClient(url, key string) (*v5.Client, error, int) {
+// getAPIClient returns the CRM client checking the key has credentials of the commands
+func getAPIClient(url, key string, commands []string) (*v5.Client, error, int) {
 	client := v5.New(url, key)
 
 	cr, _, e := client.APICredentials()
@@ -32,7 +33,7 @@ func getAPIClient(url, key string) (*v5.Client, error, int) {
 		return nil, errors.New(getLocalizedMessage("incorrect_url_key")), http.StatusBadRequest
 	}
 
-	if res := checkCredentials(cr.Credentials); len(res) != 0 {
+	if res := checkCredentials(cr.Credentials, botCommands.credentials(commands)); len(res) != 0 {
 		return nil,
 			errors.New(localizer.MustLocalize(&i18n.LocalizeConfig{
 				MessageID: "missing_credentials",
@@ -43,12 +44,16 @@ func getAPIClient(url, key string) (*v5.Client, error, int) {
 			http.StatusBadRequest
 	}
 
+	if res := checkCredentials(cr.Credentials, optionalCredentials); len(res) != 0 {
+		logger.Warning(url, "optional credentials are missing:", strings.Join(res, ", "))
+	}
+
 	return client, nil, 0
 }
 
-func checkCredentials(credential []string) []string {
-	rc := make([]string, len(botCredentials))
-	copy(rc, botCredentials)
+// checkCredentials returns required credentials missing from the granted ones
+func checkCredentials(credential []string, required []string) []string {
+	rc := append([]string(nil), required...)
 
 	for _, vc := range credential {
 		for kn, vn := range rc {
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,29 +23,46 @@ import (
 )
 
 const (
-	CommandPayment  = "/payment"
-	CommandDelivery = "/delivery"
-	CommandProduct  = "/product"
+	workerRestartDelay = 5 * time.Second
+	// workerStopTimeout is the time a restarted worker waits for the previous one to stop
+	workerStopTimeout = 10 * time.Second
 )
 
 var (
-	events         = []string{v1.WsEventMessageNew}
-	msgLen         = 2000
-	emoji          = []string{"0️⃣ ", "1️⃣ ", "2️⃣ ", "3️⃣ ", "4️⃣ ", "5️⃣ ", "6️⃣ ", "7️⃣ ", "8️⃣ ", "9️⃣ "}
-	botCommands    = []string{CommandPayment, CommandDelivery, CommandProduct}
-	botCredentials = []string{
-		"/api/integration-modules/{code}",
-		"/api/integration-modules/{code}/edit",
-		"/api/reference/payment-types",
-		"/api/reference/delivery-types",
-		"/api/store/products",
+	events = []string{
+		v1.WsEventMessageNew,
+		v1.WsEventMessageUpdated,
+		v1.WsEventChatCreated,
+		v1.WsEventDialogOpened,
+		v1.WsEventDialogClosed,
+		v1.WsEventDialogAssign,
 	}
+	msgLen = 2000
+	emoji  = []string{"0️⃣ ", "1️⃣ ", "2️⃣ ", "3️⃣ ", "4️⃣ ", "5️⃣ ", "6️⃣ ", "7️⃣ ", "8️⃣ ", "9️⃣ "}
 )
 
 type Worker struct {
 	connection *Connection
 	mutex      sync.RWMutex
 	localizer  *i18n.Localizer
+	answers    []*autoAnswer
+
+	searches      map[uint64]*productSearch
+	searchesSweep time.Time
+	searchMutex   sync.Mutex
+
+	channels      map[uint64]chatChannel
+	channelsSweep time.Time
+	channelMutex  sync.Mutex
+
+	langs      map[uint64]chatLang
+	langsSweep time.Time
+	langMutex  sync.Mutex
+
+	dialogs      map[uint64]chatDialog
+	edits        map[uint64]editedContent
+	dialogsSweep time.Time
+	dialogMutex  sync.Mutex
 
 	sentry *raven.Client
 	logger *logging.Logger
@@ -50,10 +70,73 @@ type Worker struct {
 	mgClient  *v1.MgClient
 	crmClient *v5.Client
 
-	close bool
+	references *referenceCache
+	limiter    *rateLimiter
+	pool       *commandPool
+
+	reconnect *reconnectPolicy
+	dialer    *websocket.Dialer
+	restartWS context.CancelFunc
+	// restart interrupts the reconnect delay when connection settings change
+	restart chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	stats      workerStats
+	statsMutex sync.RWMutex
+}
+
+type workerStats struct {
+	connected   bool
+	lastConnect time.Time
+	reconnects  int
+	lastError   string
+	messages    uint64
+}
+
+// WorkerInfo describes worker state for the admin API
+type WorkerInfo struct {
+	ClientID    string     `json:"clientId"`
+	APIURL      string     `json:"apiUrl"`
+	Connected   bool       `json:"connected"`
+	State       string     `json:"state"`
+	LastConnect *time.Time `json:"lastConnect,omitempty"`
+	Reconnects  int        `json:"reconnects"`
+	LastError   string     `json:"lastError,omitempty"`
+	Messages    uint64     `json:"messages"`
+	CacheHits   uint64     `json:"cacheHits"`
+	CacheMisses uint64     `json:"cacheMisses"`
+}
+
+func NewWorker(ctx context.Context, conn *Connection, sentry *raven.Client, logger *logging.Logger) *Worker {
+	w := &Worker{
+		connection: conn,
+		sentry:     sentry,
+		logger:     logger,
+		localizer:  getLang(conn.Lang),
+		answers:    connectionAnswers(conn),
+		searches:   map[uint64]*productSearch{},
+		channels:   map[uint64]chatChannel{},
+		langs:      map[uint64]chatLang{},
+		dialogs:    map[uint64]chatDialog{},
+		edits:      map[uint64]editedContent{},
+		references: newReferenceCache(config.Cache.ReferenceTTL),
+		limiter:    newRateLimiter(config.RateLimit),
+		pool:       newCommandPool(config.Commands),
+		reconnect:  newReconnectPolicy(config.Reconnect),
+		dialer:     websocket.DefaultDialer,
+		restart:    make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	w.setClients(conn)
+
+	return w
 }
 
-func NewWorker(conn *Connection, sentry *raven.Client, logger *logging.Logger) *Worker {
+func (w *Worker) setClients(conn *Connection) {
 	crmClient := v5.New(conn.APIURL, conn.APIKEY)
 	mgClient := v1.New(conn.MGURL, conn.MGToken)
 	if config.Debug {
@@ -61,46 +144,186 @@ func NewWorker(conn *Connection, sentry *raven.Client, logger *logging.Logger) *
 		mgClient.Debug = true
 	}
 
-	return &Worker{
-		connection: conn,
-		sentry:     sentry,
-		logger:     logger,
-		localizer:  getLang(conn.Lang),
-		mgClient:   mgClient,
-		crmClient:  crmClient,
-		close:      false,
-	}
+	w.crmClient = crmClient
+	w.mgClient = mgClient
 }
 
 func (w *Worker) UpdateWorker(conn *Connection) {
-	w.mutex.RLock()
-	defer w.mutex.RUnlock()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	changed := w.connection.MGURL != conn.MGURL ||
+		w.connection.MGToken != conn.MGToken ||
+		w.connection.APIURL != conn.APIURL ||
+		w.connection.APIKEY != conn.APIKEY
 
 	w.localizer = getLang(conn.Lang)
+	w.answers = connectionAnswers(conn)
 	w.connection = conn
+	w.references.invalidate()
+
+	if changed {
+		w.setClients(conn)
+		if w.restartWS != nil {
+			w.restartWS()
+		}
+
+		select {
+		case w.restart <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Stop closes websocket connection and stops the worker
+func (w *Worker) Stop() {
+	w.cancel()
+}
+
+// Done returns a channel that is closed when the worker is stopped
+func (w *Worker) Done() <-chan struct{} {
+	return w.done
+}
+
+func (w *Worker) getConnection() *Connection {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	return w.connection
+}
+
+func (w *Worker) getLocalizer() *i18n.Localizer {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	return w.localizer
+}
+
+func (w *Worker) getAnswers() []*autoAnswer {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	return w.answers
+}
+
+// connectionAnswers compiles auto answers of the connection, rules are validated
+// when settings are saved so rules stored before a validation change are logged and skipped
+func connectionAnswers(conn *Connection) []*autoAnswer {
+	rules := conn.getAutoAnswers().Rules
+	res := make([]*autoAnswer, 0, len(rules))
+
+	for _, v := range rules {
+		a, err := v.compile()
+		if err != nil {
+			logger.Error(conn.APIURL, "invalid auto answer:", err)
+			continue
+		}
+		res = append(res, a)
+	}
+
+	return res
+}
+
+func (w *Worker) getCRMClient() *v5.Client {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	return w.crmClient
+}
+
+func (w *Worker) getMGClient() *v1.MgClient {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	return w.mgClient
+}
+
+// State returns websocket reconnect breaker state
+func (w *Worker) State() BreakerState {
+	return w.reconnect.State()
+}
+
+// Info returns worker connection state and statistics
+func (w *Worker) Info() WorkerInfo {
+	conn := w.getConnection()
+
+	w.statsMutex.RLock()
+	defer w.statsMutex.RUnlock()
+
+	info := WorkerInfo{
+		ClientID:   conn.ClientID,
+		APIURL:     conn.APIURL,
+		Connected:  w.stats.connected,
+		State:      w.State().String(),
+		Reconnects: w.stats.reconnects,
+		LastError:  w.stats.lastError,
+		Messages:   w.stats.messages,
+	}
+
+	if !w.stats.lastConnect.IsZero() {
+		lastConnect := w.stats.lastConnect
+		info.LastConnect = &lastConnect
+	}
+
+	info.CacheHits, info.CacheMisses = w.references.stats()
+
+	return info
+}
+
+func (w *Worker) setConnected(connected bool) {
+	w.statsMutex.Lock()
+	defer w.statsMutex.Unlock()
+
+	w.stats.connected = connected
+	if connected {
+		w.stats.lastConnect = time.Now()
+	}
+}
+
+func (w *Worker) addReconnectError(err error) {
+	w.statsMutex.Lock()
+	defer w.statsMutex.Unlock()
+
+	w.stats.reconnects++
+	w.stats.lastError = err.Error()
+}
+
+func (w *Worker) incMessages() {
+	w.statsMutex.Lock()
+	defer w.statsMutex.Unlock()
+
+	w.stats.messages++
 }
 
 func (w *Worker) sendSentry(err error) {
+	conn := w.getConnection()
 	tags := map[string]string{
-		"crm":        w.connection.APIURL,
-		"active":     strconv.FormatBool(w.connection.Active),
-		"lang":       w.connection.Lang,
-		"currency":   w.connection.Currency,
-		"updated_at": w.connection.UpdatedAt.String(),
+		"crm":        conn.APIURL,
+		"active":     strconv.FormatBool(conn.Active),
+		"lang":       conn.Lang,
+		"currency":   conn.Currency,
+		"updated_at": conn.UpdatedAt.String(),
 	}
 
-	w.logger.Errorf("ws url: %s\nmgClient: %v\nerr: %v", w.crmClient.URL, w.mgClient, err)
+	w.logger.Errorf("ws url: %s\nmgClient: %v\nerr: %v", conn.APIURL, w.getMGClient(), err)
 	go w.sentry.CaptureError(err, tags)
 }
 
 type WorkersManager struct {
 	mutex   sync.RWMutex
 	workers map[string]*Worker
+
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func NewWorkersManager() *WorkersManager {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &WorkersManager{
 		workers: map[string]*Worker{},
+		ctx:     ctx,
+		cancel:  cancel,
 	}
 }
 
@@ -113,8 +336,42 @@ func (wm *WorkersManager) setWorker(conn *Connection) {
 		if ok {
 			worker.UpdateWorker(conn)
 		} else {
-			wm.workers[conn.ClientID] = NewWorker(conn, sentry, logger)
-			go wm.workers[conn.ClientID].UpWS()
+			worker = NewWorker(wm.ctx, conn, sentry, logger)
+			wm.workers[conn.ClientID] = worker
+			go wm.superviseWorker(worker)
+		}
+	}
+}
+
+func (wm *WorkersManager) getWorker(clientID string) (*Worker, bool) {
+	wm.mutex.RLock()
+	defer wm.mutex.RUnlock()
+
+	worker, ok := wm.workers[clientID]
+
+	return worker, ok
+}
+
+// superviseWorker restarts UpWS until the worker is stopped
+func (wm *WorkersManager) superviseWorker(w *Worker) {
+	defer close(w.done)
+
+	w.pool.Start()
+	defer w.pool.Stop()
+
+	w.syncCommands()
+
+	for {
+		w.runWS()
+		if w.ctx.Err() != nil {
+			return
+		}
+
+		w.logger.Warningf("%s - ws worker exited, restarting", w.getConnection().APIURL)
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-time.After(workerRestartDelay):
 		}
 	}
 }
@@ -125,241 +382,517 @@ func (wm *WorkersManager) stopWorker(conn *Connection) {
 
 	worker, ok := wm.workers[conn.ClientID]
 	if ok {
-		worker.close = true
+		worker.Stop()
 		delete(wm.workers, conn.ClientID)
 	}
 }
 
-func (w *Worker) UpWS() {
-	data, header, err := w.mgClient.WsMeta(events)
-	if err != nil {
-		w.sendSentry(err)
-		return
+// listWorkers returns workers sorted by client ID
+func (wm *WorkersManager) listWorkers() []*Worker {
+	wm.mutex.RLock()
+	defer wm.mutex.RUnlock()
+
+	workers := make([]*Worker, 0, len(wm.workers))
+	for _, w := range wm.workers {
+		workers = append(workers, w)
 	}
 
-ROOT:
-	for {
-		if w.close {
-			if config.Debug {
-				w.logger.Debug("stop ws:", w.connection.APIURL)
-			}
-			return
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].getConnection().ClientID < workers[j].getConnection().ClientID
+	})
+
+	return workers
+}
+
+// restartWorker stops the worker and starts a new one for the same connection,
+// the new worker connects once the previous one is done so events are not handled twice
+func (wm *WorkersManager) restartWorker(clientID string) (*Worker, bool) {
+	wm.mutex.Lock()
+	defer wm.mutex.Unlock()
+
+	prev, ok := wm.workers[clientID]
+	if !ok {
+		return nil, false
+	}
+
+	prev.Stop()
+
+	worker := NewWorker(wm.ctx, prev.getConnection(), sentry, logger)
+	wm.workers[clientID] = worker
+
+	go func() {
+		select {
+		case <-prev.Done():
+		case <-time.After(workerStopTimeout):
+			logger.Warningf("%s - previous worker did not stop in %s", prev.getConnection().APIURL, workerStopTimeout)
 		}
-		ws, _, err := websocket.DefaultDialer.Dial(data, header)
-		if err != nil {
-			w.sendSentry(err)
-			time.Sleep(1000 * time.Millisecond)
-			continue ROOT
+
+		wm.superviseWorker(worker)
+	}()
+
+	return worker, true
+}
+
+// Shutdown closes websockets of all workers and waits
+// for commands in progress until the context is done
+func (wm *WorkersManager) Shutdown(ctx context.Context) {
+	wm.cancel()
+
+	workers := wm.listWorkers()
+
+	for _, w := range workers {
+		select {
+		case <-w.Done():
+		case <-ctx.Done():
+			logger.Warning("workers shutdown timeout exceeded")
+			return
 		}
+	}
+}
 
-		if config.Debug {
-			w.logger.Info("start ws: ", w.crmClient.URL)
+// runWS runs UpWS and recovers from its panics
+func (w *Worker) runWS() {
+	defer func() {
+		if rec := recover(); rec != nil {
+			w.sendSentry(fmt.Errorf("ws worker panic: %v", rec))
 		}
+	}()
 
-		for {
-			var wsEvent v1.WsEvent
-			err = ws.ReadJSON(&wsEvent)
-			if err != nil {
-				w.sendSentry(err)
-				if websocket.IsUnexpectedCloseError(err) {
-					continue ROOT
-				}
-				continue
-			}
+	w.UpWS()
+}
 
-			if w.close {
-				if config.Debug {
-					w.logger.Debug("stop ws:", w.connection.APIURL)
+func (w *Worker) UpWS() {
+	for {
+		if delay := w.reconnect.Delay(); delay > 0 {
+			select {
+			case <-w.ctx.Done():
+			case <-w.restart:
+				// previous failures do not matter for the new connection settings
+				if w.reconnect.Reset() {
+					w.logger.Infof("%s - ws reconnect breaker is %s", w.getConnection().APIURL, w.reconnect.State())
 				}
-				return
-			}
-
-			var eventData v1.WsEventMessageNewData
-			err = json.Unmarshal(wsEvent.Data, &eventData)
-			if err != nil {
-				w.sendSentry(err)
-				continue
+			case <-time.After(delay):
 			}
+		}
 
-			if eventData.Message.Type != "command" {
-				continue
+		if w.ctx.Err() != nil {
+			if config.Debug {
+				w.logger.Debug("stop ws:", w.getConnection().APIURL)
 			}
+			return
+		}
 
-			msg, msgProd, err := w.execCommand(eventData.Message.Content)
-			if err != nil {
-				w.sendSentry(err)
-				msg = w.localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "incorrect_key"})
-			}
+		if w.reconnect.Attempt() {
+			w.logger.Infof("%s - ws reconnect breaker is %s", w.getConnection().APIURL, w.reconnect.State())
+		}
 
-			msgSend := v1.MessageSendRequest{
-				Scope:  v1.MessageScopePrivate,
-				ChatID: eventData.Message.ChatID,
-			}
+		connCtx, connCancel := context.WithCancel(w.ctx)
+		w.mutex.Lock()
+		w.restartWS = connCancel
+		mgClient := w.mgClient
+		// the client is up to date, so a pending restart is already handled
+		select {
+		case <-w.restart:
+		default:
+		}
+		w.mutex.Unlock()
 
-			if msg != "" {
-				msgSend.Type = v1.MsgTypeText
-				msgSend.Content = msg
-			} else if msgProd.ID != 0 {
-				msgSend.Type = v1.MsgTypeProduct
-				msgSend.Product = &msgProd
-			}
+		err := w.serveWS(connCtx, mgClient)
+		connCancel()
 
-			if msgSend.Type != "" {
-				d, status, err := w.mgClient.MessageSend(msgSend)
-				if err != nil {
-					w.logger.Warningf("MessageSend status: %d\nMessageSend err: %v\nMessageSend data: %v", status, err, d)
-					continue
-				}
-			}
+		if err != nil && w.ctx.Err() == nil {
+			w.reconnectFailed(err)
 		}
-		time.Sleep(500 * time.Millisecond)
 	}
 }
 
-func checkErrors(err errs.Failure) error {
-	if err.RuntimeErr != nil {
-		return err.RuntimeErr
+// serveWS dials MG websocket and reads events until the connection
+// is broken or the context is done
+func (w *Worker) serveWS(ctx context.Context, mgClient *v1.MgClient) error {
+	data, header, err := mgClient.WsMeta(events)
+	if err != nil {
+		return err
 	}
 
-	if err.ApiErr != "" {
-		return errors.New(err.ApiErr)
+	ws, _, err := w.dialer.Dial(data, header)
+	if err != nil {
+		return err
 	}
+	defer ws.Close()
 
-	return nil
-}
+	if w.reconnect.Success() {
+		w.logger.Infof("%s - ws reconnect breaker is %s", w.getConnection().APIURL, w.reconnect.State())
+	}
 
-func parseCommand(ci string) (co string, params v5.ProductsRequest, err error) {
-	s := strings.Split(ci, " ")
+	w.setConnected(true)
+	defer w.setConnected(false)
 
-	for _, cmd := range botCommands {
-		if s[0] == cmd {
-			if len(s) > 1 && cmd == CommandProduct {
-				params.Filter = v5.ProductsFilter{
-					Name: ci[len(CommandProduct)+1:],
-				}
-			}
-			co = s[0]
-			break
-		}
+	if config.Debug {
+		w.logger.Info("start ws: ", mgClient.URL)
 	}
 
-	return
+	stop := make(chan struct{})
+	defer close(stop)
+	go closeOnDone(ctx, ws, stop)
+
+	err = w.readWS(ws)
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	return err
 }
 
-func (w *Worker) execCommand(message string) (resMes string, msgProd v1.MessageProduct, err error) {
-	var s []string
+// closeOnDone sends a close frame to MG when the context is done
+func closeOnDone(ctx context.Context, ws *websocket.Conn, stop chan struct{}) {
+	select {
+	case <-stop:
+	case <-ctx.Done():
+		ws.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(time.Second),
+		)
+		ws.Close()
+	}
+}
 
-	command, params, err := parseCommand(message)
-	if err != nil {
+// reconnectFailed reports connection errors to Sentry only when the breaker opens
+func (w *Worker) reconnectFailed(err error) {
+	w.addReconnectError(err)
+
+	from := w.reconnect.State()
+	if !w.reconnect.Failure() {
+		w.logger.Warningf("%s - ws connection error: %v", w.getConnection().APIURL, err)
 		return
 	}
 
-	switch command {
-	case CommandPayment:
-		res, _, er := w.crmClient.PaymentTypes()
-		err = checkErrors(er)
+	w.logger.Infof("%s - ws reconnect breaker is %s", w.getConnection().APIURL, w.reconnect.State())
+	if from == BreakerClosed {
+		w.sendSentry(err)
+	}
+}
+
+func (w *Worker) readWS(ws *websocket.Conn) error {
+	for {
+		var wsEvent v1.WsEvent
+
+		_, message, err := ws.ReadMessage()
 		if err != nil {
-			logger.Errorf("%s - Cannot retrieve payment types, error: %s", w.crmClient.URL, err.Error())
-			return
+			return err
 		}
-		for _, v := range res.PaymentTypes {
-			if v.Active {
-				s = append(s, v.Name)
-			}
+
+		err = json.Unmarshal(message, &wsEvent)
+		if err != nil {
+			w.sendSentry(err)
+			continue
 		}
-		if len(s) > 0 {
-			resMes = fmt.Sprintf("%s\n\n", w.localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "payment_options"}))
+
+		wsEventsTotal.WithLabelValues(wsEvent.Type).Inc()
+		w.handleEvent(wsEvent)
+	}
+}
+
+func (w *Worker) handleEvent(wsEvent v1.WsEvent) {
+	switch wsEvent.Type {
+	case v1.WsEventMessageNew:
+		var data v1.WsEventMessageNewData
+		if w.unmarshalEvent(wsEvent, &data) {
+			w.handleMessageNew(data.Message)
 		}
-	case CommandDelivery:
-		res, _, er := w.crmClient.DeliveryTypes()
-		err = checkErrors(er)
-		if err != nil {
-			logger.Errorf("%s - Cannot retrieve delivery types, error: %s", w.crmClient.URL, err.Error())
-			return
+	case v1.WsEventMessageUpdated:
+		var data v1.WsEventMessageUpdatedData
+		if w.unmarshalEvent(wsEvent, &data) {
+			w.handleMessageUpdated(data.Message)
 		}
-		for _, v := range res.DeliveryTypes {
-			if v.Active {
-				s = append(s, v.Name)
-			}
+	case v1.WsEventChatCreated:
+		var data v1.WsEventChatCreatedData
+		if w.unmarshalEvent(wsEvent, &data) {
+			w.handleChatCreated(data.Chat)
+		}
+	case v1.WsEventDialogOpened:
+		var data v1.WsEventDialogOpenedData
+		if w.unmarshalEvent(wsEvent, &data) {
+			w.handleDialogOpened(data.Dialog)
+		}
+	case v1.WsEventDialogClosed:
+		var data v1.WsEventDialogClosedData
+		if w.unmarshalEvent(wsEvent, &data) {
+			w.handleDialogClosed(data.Dialog)
 		}
-		if len(s) > 0 {
-			resMes = fmt.Sprintf("%s\n\n", w.localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "delivery_options"}))
+	case v1.WsEventDialogAssign:
+		var data v1.WsEventDialogAssignData
+		if w.unmarshalEvent(wsEvent, &data) {
+			w.handleDialogAssign(data)
 		}
-	case CommandProduct:
-		if params.Filter.Name == "" {
-			resMes = w.localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "set_name_or_article"})
+	}
+}
+
+func (w *Worker) handleMessageNew(message *v1.Message) {
+	if message == nil {
+		return
+	}
+
+	switch {
+	case message.Type == v1.MsgTypeCommand:
+		w.handleCommand(message)
+	case isAutoAnswerMessage(message) && len(w.getAnswers()) > 0:
+		w.incMessages()
+
+		// auto answers are never sent to notify about the rate limit
+		if allowed, scope, _ := w.limiter.Allow(message.ChatID); !allowed {
+			commandsRejectedTotal.WithLabelValues(scope).Inc()
 			return
 		}
 
-		res, _, er := w.crmClient.Products(params)
-		err = checkErrors(er)
-		if err != nil {
-			logger.Errorf("%s - Cannot retrieve product, error: %s", w.crmClient.URL, err.Error())
+		w.enqueue(message.ChatID, func() {
+			w.replyAutoAnswer(message)
+		})
+	}
+}
+
+// handleCommand queues the command reply, a command over the rate limit
+// is answered with the limit message once
+func (w *Worker) handleCommand(message *v1.Message) {
+	w.incMessages()
+
+	allowed, scope, notify := w.limiter.Allow(message.ChatID)
+	if !allowed {
+		commandsRejectedTotal.WithLabelValues(scope).Inc()
+		if !notify {
 			return
 		}
+	}
 
-		if len(res.Products) > 0 {
-			for _, vp := range res.Products {
-				if vp.Active {
-					vo := searchOffer(vp.Offers, params.Filter.Name)
-					msgProd = v1.MessageProduct{
-						ID:      uint64(vo.ID),
-						Name:    vo.Name,
-						Article: vo.Article,
-						Url:     vp.URL,
-						Img:     vp.ImageURL,
-						Cost: &v1.MessageOrderCost{
-							Value:    vo.Price,
-							Currency: w.connection.Currency,
-						},
-					}
-
-					if vp.Quantity > 0 {
-						msgProd.Quantity = &v1.MessageOrderQuantity{
-							Value: vp.Quantity,
-							Unit:  vo.Unit.Sym,
-						}
-					}
-
-					if len(vo.Images) > 0 {
-						msgProd.Img = vo.Images[0]
-					}
-
-					return
-				}
+	queued := w.enqueue(message.ChatID, func() {
+		w.replyCommand(message, allowed)
+	})
+	if !queued {
+		go w.replyBusy(message)
+	}
+}
+
+// enqueue passes the task to the commands pool without blocking the websocket reader,
+// it returns false when the chat queue is full and the task is dropped
+func (w *Worker) enqueue(chatID uint64, task func()) bool {
+	run := func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				w.sendSentry(fmt.Errorf("command panic: %v", rec))
 			}
+		}()
 
-		}
+		task()
+	}
+
+	select {
+	case w.pool.Queue(chatID) <- run:
+		return true
 	default:
+		tasksDroppedTotal.Inc()
+		w.logger.Warningf("%s - Queue of chat %d is full, the task is dropped", w.getConnection().APIURL, chatID)
+		return false
+	}
+}
+
+// replyBusy tells the chat the command was dropped because the queue is full
+func (w *Worker) replyBusy(message *v1.Message) {
+	loc := w.chatLocalizer(message)
+	msg := loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "commands_busy"})
+
+	w.sendReply(loc, message.ChatID, v1.MessageScopePrivate, msg, v1.MessageProduct{})
+}
+
+// replyCommand executes the command and sends the result to the chat,
+// a command rejected by the rate limiter is answered with the limit message
+func (w *Worker) replyCommand(message *v1.Message, allowed bool) {
+	var (
+		msg     string
+		msgProd v1.MessageProduct
+		err     error
+		chatID  = message.ChatID
+		loc     = w.chatLocalizer(message)
+	)
+
+	if !allowed {
+		msg = loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "too_many_requests"})
+	} else {
+		msg, msgProd, err = w.execCommand(loc, chatID, message.Content)
+		if err != nil {
+			w.sendSentry(err)
+			msg = loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "incorrect_key"})
+		}
+	}
+
+	w.sendReply(loc, chatID, v1.MessageScopePrivate, msg, msgProd)
+}
+
+// sendReply sends the product card and the text split into parts to the chat,
+// private messages are only shown to operators
+func (w *Worker) sendReply(loc *i18n.Localizer, chatID uint64, scope, msg string, msgProd v1.MessageProduct) {
+	var messages []v1.MessageSendRequest
+
+	if msgProd.ID != 0 {
+		messages = append(messages, v1.MessageSendRequest{
+			Type:    v1.MsgTypeProduct,
+			Scope:   scope,
+			ChatID:  chatID,
+			Product: &msgProd,
+		})
+	}
+
+	if msg != "" {
+		continued := loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "message_continued"})
+		for _, part := range splitMessage(msg, msgLen, continued) {
+			messages = append(messages, v1.MessageSendRequest{
+				Type:    v1.MsgTypeText,
+				Scope:   scope,
+				ChatID:  chatID,
+				Content: part,
+			})
+		}
+	}
+
+	for _, msgSend := range messages {
+		d, status, err := w.getMGClient().MessageSend(msgSend)
+		if err != nil {
+			messageSendFailuresTotal.Inc()
+			w.logger.Warningf("MessageSend status: %d\nMessageSend err: %v\nMessageSend data: %v", status, err, d)
+			return
+		}
+	}
+}
+
+func checkErrors(err errs.Failure) error {
+	if err.RuntimeErr != nil {
+		return err.RuntimeErr
+	}
+
+	if err.ApiErr != "" {
+		return errors.New(err.ApiErr)
+	}
+
+	return nil
+}
+
+func (w *Worker) execCommand(loc *i18n.Localizer, chatID uint64, message string) (resMes string, msgProd v1.MessageProduct, err error) {
+	cmd, line := botCommands.parse(message)
+	if cmd == nil {
 		return
 	}
 
-	if len(s) == 0 {
-		resMes = w.localizer.MustLocalize(&i18n.LocalizeConfig{MessageID: "not_found"})
+	command := cmd.Name()
+	if !w.getConnection().isCommandEnabled(command) {
+		commandsTotal.WithLabelValues(command, "disabled").Inc()
+		resMes = loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "command_disabled"})
 		return
 	}
 
-	if len(s) > 1 {
-		for k, v := range s {
-			var a string
-			for _, iv := range strings.Split(strconv.Itoa(k+1), "") {
-				t, _ := strconv.Atoi(iv)
-				a += emoji[t]
-			}
-			s[k] = fmt.Sprintf("%v %v", a, v)
+	defer func() {
+		commandsTotal.WithLabelValues(command, commandResult(err)).Inc()
+	}()
+
+	return cmd.Handle(w, commandRequest{
+		Localizer: loc,
+		ChatID:    chatID,
+		Arg:       strings.Join(line.Args, " "),
+		Args:      line.Args,
+		Flags:     line.Flags,
+	})
+}
+
+func (w *Worker) orderInfo(loc *i18n.Localizer, number string) (resMes string, err error) {
+	observe := crmRequestTimer("Orders")
+	res, _, er := w.getCRMClient().Orders(v5.OrdersRequest{
+		Filter: v5.OrdersFilter{
+			Numbers: []string{number},
+		},
+	})
+	observe()
+	err = checkErrors(er)
+	if err != nil {
+		logger.Errorf("%s - Cannot retrieve order, error: %s", w.getCRMClient().URL, err.Error())
+		return
+	}
+
+	if len(res.Orders) == 0 {
+		resMes = loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "not_found"})
+		return
+	}
+
+	order := res.Orders[0]
+
+	statuses, err := w.statuses()
+	if err != nil {
+		logger.Errorf("%s - Cannot retrieve statuses, error: %s", w.getCRMClient().URL, err.Error())
+		return
+	}
+
+	deliveryTypes, err := w.deliveryTypes()
+	if err != nil {
+		logger.Errorf("%s - Cannot retrieve delivery types, error: %s", w.getCRMClient().URL, err.Error())
+		return
+	}
+
+	paymentStatuses, err := w.paymentStatuses()
+	if err != nil {
+		logger.Errorf("%s - Cannot retrieve payment statuses, error: %s", w.getCRMClient().URL, err.Error())
+		return
+	}
+
+	status := order.Status
+	if v, ok := statuses[order.Status]; ok {
+		status = v.Name
+	}
+
+	var delivery string
+	if order.Delivery != nil {
+		delivery = order.Delivery.Code
+		if v, ok := deliveryTypes[order.Delivery.Code]; ok {
+			delivery = v.Name
 		}
 	}
 
-	str := strings.Join(s, "\n")
-	resMes += str
+	var payments []string
+	for _, p := range order.Payments {
+		if v, ok := paymentStatuses[p.Status]; ok {
+			payments = append(payments, v.Name)
+		} else if p.Status != "" {
+			payments = append(payments, p.Status)
+		}
+	}
 
-	if len(resMes) > msgLen {
-		resMes = resMes[:msgLen]
+	data := orderReplyData{
+		Order:    order,
+		Number:   order.Number,
+		Status:   status,
+		Delivery: delivery,
+		Payment:  strings.Join(payments, ", "),
+		Total:    order.TotalSumm,
+		Currency: w.siteCurrency(order.Site),
 	}
 
+	resMes = w.renderReply(replyOrder, data, func() string {
+		return loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "order_response", TemplateData: data})
+	})
+
 	return
 }
 
+// siteCurrency returns the site currency falling back to the connection currency
+func (w *Worker) siteCurrency(site string) string {
+	if site != "" {
+		sites, err := w.sites()
+		if err != nil {
+			logger.Errorf("%s - Cannot retrieve sites, error: %s", w.getCRMClient().URL, err.Error())
+		} else if s, ok := sites[site]; ok && s.Currency != "" {
+			return strings.ToLower(s.Currency)
+		}
+	}
+
+	return w.getConnection().Currency
+}
+
 func searchOffer(offers []v5.Offer, filter string) (offer v5.Offer) {
 	for _, o := range offers {
 		if o.Article == filter {
@@ -382,27 +915,51 @@ func searchOffer(offers []v5.Offer, filter string) (offer v5.Offer) {
 	return
 }
 
-func SetBotCommand(botURL, botToken string) (code int, err error) {
+// SetBotCommand registers enabled commands in MG and deletes disabled ones,
+// descriptions are localized in the connection language whoever changes the commands
+func SetBotCommand(botURL, botToken string, commands []string, loc *i18n.Localizer) (code int, err error) {
 	var client = v1.New(botURL, botToken)
 
-	_, code, err = client.CommandEdit(v1.CommandEditRequest{
-		Name:        getTextCommand(CommandPayment),
-		Description: getLocalizedMessage("get_payment"),
-	})
+	for _, cmd := range botCommands.all() {
+		enabled := false
+		for _, v := range commands {
+			if v == cmd.Name() {
+				enabled = true
+				break
+			}
+		}
 
-	_, code, err = client.CommandEdit(v1.CommandEditRequest{
-		Name:        getTextCommand(CommandDelivery),
-		Description: getLocalizedMessage("get_delivery"),
-	})
+		if enabled {
+			_, code, err = client.CommandEdit(v1.CommandEditRequest{
+				Name:        getTextCommand(cmd.Name()),
+				Description: loc.MustLocalize(&i18n.LocalizeConfig{MessageID: cmd.Description()}),
+			})
+		} else {
+			_, code, err = client.CommandDelete(getTextCommand(cmd.Name()))
+			if code == http.StatusNotFound {
+				code, err = http.StatusOK, nil
+			}
+		}
 
-	_, code, err = client.CommandEdit(v1.CommandEditRequest{
-		Name:        getTextCommand(CommandProduct),
-		Description: getLocalizedMessage("get_product"),
-	})
+		if err != nil {
+			return
+		}
+	}
 
 	return
 }
 
+// syncCommands registers enabled commands in MG with descriptions in the bot language,
+// so commands enabled by migrations appear in chats
+func (w *Worker) syncCommands() {
+	conn := w.getConnection()
+
+	code, err := SetBotCommand(conn.MGURL, conn.MGToken, conn.getCommands(), getLang(conn.Lang))
+	if err != nil {
+		w.logger.Errorf("%s - Cannot sync commands with MG, code: %d, error: %v", conn.APIURL, code, err)
+	}
+}
+
 func getTextCommand(command string) string {
 	return strings.Replace(command, "/", "", -1)
 }
@@ -0,0 +1,1382 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/h2non/gock"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"github.com/prometheus/client_golang/prometheus"
+	v5 "github.com/retailcrm/api-client-go/v5"
+	v1 "github.com/retailcrm/mg-bot-api-client-go/v1"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/language"
+)
+
+func newTestWSServer(connected chan struct{}, closed chan int) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		connected <- struct{}{}
+
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				if e, ok := err.(*websocket.CloseError); ok {
+					closed <- e.Code
+				}
+				return
+			}
+		}
+	}))
+}
+
+func TestWorker_Stop(t *testing.T) {
+	connected := make(chan struct{}, 1)
+	closed := make(chan int, 1)
+	srv := newTestWSServer(connected, closed)
+	defer srv.Close()
+
+	manager := NewWorkersManager()
+	w := NewWorker(manager.ctx, &Connection{
+		ClientID: "stop",
+		APIURL:   crmUrl,
+		MGURL:    srv.URL,
+		MGToken:  "token",
+		Active:   true,
+	}, sentry, logger)
+	w.dialer = &websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+
+	go manager.superviseWorker(w)
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not connect")
+	}
+
+	w.Stop()
+
+	select {
+	case <-w.Done():
+	case <-time.After(time.Second):
+		t.Fatal("worker did not stop")
+	}
+
+	select {
+	case code := <-closed:
+		assert.Equal(t, websocket.CloseNormalClosure, code)
+	case <-time.After(time.Second):
+		t.Error("close frame was not sent")
+	}
+}
+
+func TestWorker_syncCommands(t *testing.T) {
+	defer gock.Off()
+
+	mgURL := "https://mg.example.com"
+	conn := &Connection{
+		ClientID: "sync",
+		APIURL:   crmUrl,
+		MGURL:    mgURL,
+		MGToken:  "token",
+		Lang:     "es",
+	}
+	conn.setCommands([]string{CommandPayment, CommandOrder})
+
+	gock.New(mgURL).
+		Put("/api/bot/v1/my/commands/payment").
+		BodyString(`Obtener tipos de pago`).
+		Reply(200).
+		BodyString(`{}`)
+	gock.New(mgURL).
+		Put("/api/bot/v1/my/commands/order").
+		Reply(200).
+		BodyString(`{}`)
+	for _, v := range []string{"delivery", "product", "help"} {
+		gock.New(mgURL).
+			Delete("/api/bot/v1/my/commands/" + v).
+			Reply(404).
+			BodyString(`{"errors": ["not found"]}`)
+	}
+
+	NewWorker(context.Background(), conn, sentry, logger).syncCommands()
+
+	assert.True(t, gock.IsDone())
+}
+
+func TestWorkersManager_restartWorker(t *testing.T) {
+	defer gock.Off()
+	// the new worker keeps syncing and connecting until it is stopped
+	defer gock.CleanUnmatchedRequest()
+
+	mgURL := "https://mg.example.com"
+	conn := &Connection{
+		ClientID: "restart-worker",
+		APIURL:   crmUrl,
+		MGURL:    mgURL,
+		MGToken:  "token",
+		Lang:     "en",
+		Active:   true,
+	}
+	conn.setCommands([]string{CommandPayment})
+
+	// the previous worker is not supervised, so it is done only when the test says so
+	manager := NewWorkersManager()
+	prev := NewWorker(manager.ctx, conn, sentry, logger)
+	manager.workers[conn.ClientID] = prev
+
+	gock.New(mgURL).
+		Put("/api/bot/v1/my/commands/payment").
+		Reply(200).
+		BodyString(`{}`)
+
+	w, ok := manager.restartWorker(conn.ClientID)
+	if !assert.True(t, ok) {
+		return
+	}
+	defer func() {
+		w.Stop()
+		<-w.Done()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, gock.IsPending(), "the new worker started before the previous one was done")
+
+	close(prev.done)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for gock.IsPending() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, gock.IsDone())
+}
+
+func TestWorkersManager_Concurrent(t *testing.T) {
+	srv := newTestWSServer(make(chan struct{}, 100), make(chan int, 100))
+	defer srv.Close()
+
+	manager := NewWorkersManager()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			conn := &Connection{
+				ClientID: fmt.Sprintf("client%d", i%3),
+				APIURL:   crmUrl,
+				MGURL:    srv.URL,
+				MGToken:  "token",
+				Active:   true,
+			}
+
+			for j := 0; j < 10; j++ {
+				manager.setWorker(conn)
+				if w, ok := manager.getWorker(conn.ClientID); ok {
+					w.UpdateWorker(&Connection{
+						ClientID: conn.ClientID,
+						APIURL:   crmUrl,
+						MGURL:    srv.URL,
+						MGToken:  fmt.Sprintf("token%d", j),
+						Active:   true,
+						Lang:     "en",
+					})
+					w.getConnection()
+				}
+
+				if j%2 == 0 {
+					manager.stopWorker(conn)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	workers := manager.listWorkers()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	manager.Shutdown(ctx)
+
+	for _, w := range workers {
+		select {
+		case <-w.Done():
+		default:
+			t.Error("worker did not stop on shutdown")
+		}
+	}
+}
+
+func TestReconnectPolicy_Delay(t *testing.T) {
+	p := &reconnectPolicy{
+		baseDelay:   time.Second,
+		maxDelay:    8 * time.Second,
+		openTimeout: time.Minute,
+		threshold:   100,
+	}
+
+	assert.Zero(t, p.Delay())
+
+	for _, v := range []time.Duration{1, 2, 4, 8, 8, 8} {
+		p.Failure()
+
+		max := v * time.Second
+		for i := 0; i < 10; i++ {
+			delay := p.Delay()
+			assert.True(t, delay >= max/2 && delay <= max, "failures: %d, delay: %s", p.failures, delay)
+		}
+	}
+
+	p.failures = 40
+	assert.True(t, p.Delay() <= p.maxDelay)
+
+	assert.False(t, p.Success())
+	assert.Zero(t, p.Delay())
+}
+
+func TestReconnectPolicy_Breaker(t *testing.T) {
+	p := newReconnectPolicy(ReconnectConfig{FailureThreshold: 3, OpenTimeout: 60})
+
+	assert.False(t, p.Failure())
+	assert.False(t, p.Failure())
+	assert.Equal(t, BreakerClosed, p.State())
+
+	assert.True(t, p.Failure())
+	assert.Equal(t, BreakerOpen, p.State())
+	assert.True(t, p.Delay() > 59*time.Second)
+
+	assert.False(t, p.Attempt())
+	assert.Equal(t, BreakerOpen, p.State())
+
+	p.openedAt = time.Now().Add(-time.Minute)
+	assert.True(t, p.Delay() <= 0)
+	assert.True(t, p.Attempt())
+	assert.Equal(t, BreakerHalfOpen, p.State())
+
+	assert.True(t, p.Failure())
+	assert.Equal(t, BreakerOpen, p.State())
+
+	p.openedAt = time.Now().Add(-time.Minute)
+	assert.True(t, p.Attempt())
+	assert.True(t, p.Success())
+	assert.Equal(t, BreakerClosed, p.State())
+	assert.Zero(t, p.Delay())
+
+	for i := 0; i < 3; i++ {
+		p.Failure()
+	}
+	assert.Equal(t, BreakerOpen, p.State())
+	assert.True(t, p.Reset())
+	assert.Equal(t, BreakerClosed, p.State())
+	assert.Zero(t, p.Delay())
+}
+
+func TestWorker_UpdateWorkerInterruptsDelay(t *testing.T) {
+	connected := make(chan struct{}, 1)
+	closed := make(chan int, 1)
+	srv := newTestWSServer(connected, closed)
+	defer srv.Close()
+
+	manager := NewWorkersManager()
+	w := NewWorker(manager.ctx, &Connection{
+		ClientID: "restart",
+		APIURL:   crmUrl,
+		MGURL:    "https://127.0.0.1:1",
+		MGToken:  "token",
+		Active:   true,
+	}, sentry, logger)
+	w.dialer = &websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	w.reconnect = newReconnectPolicy(ReconnectConfig{FailureThreshold: 1, OpenTimeout: 3600})
+	w.reconnect.Failure()
+
+	go manager.superviseWorker(w)
+	defer func() {
+		w.Stop()
+		<-w.Done()
+	}()
+
+	w.UpdateWorker(&Connection{
+		ClientID: "restart",
+		APIURL:   crmUrl,
+		MGURL:    srv.URL,
+		MGToken:  "token",
+		Active:   true,
+	})
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not reconnect after the update")
+	}
+
+	assert.Equal(t, BreakerClosed, w.State())
+}
+
+func TestReferenceCache(t *testing.T) {
+	c := newReferenceCache(60)
+
+	var loads int
+	load := func() (interface{}, error) {
+		loads++
+		return loads, nil
+	}
+
+	v, err := c.get(referenceStatuses, load)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v)
+
+	v, err = c.get(referenceStatuses, load)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v)
+
+	c.invalidate()
+
+	v, err = c.get(referenceStatuses, load)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, v)
+
+	hits, misses := c.stats()
+	assert.Equal(t, uint64(1), hits)
+	assert.Equal(t, uint64(2), misses)
+
+	_, err = c.get(referencePaymentTypes, func() (interface{}, error) {
+		return nil, fmt.Errorf("crm is unavailable")
+	})
+	assert.Error(t, err)
+}
+
+func TestRateLimiter_Allow(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{ChatRate: 1, ChatBurst: 2, ConnectionRate: 1, ConnectionBurst: 3})
+
+	for i := 0; i < 2; i++ {
+		ok, _, _ := l.Allow(1)
+		assert.True(t, ok)
+	}
+
+	ok, scope, notify := l.Allow(1)
+	assert.False(t, ok)
+	assert.Equal(t, rateLimitChat, scope)
+	assert.True(t, notify)
+
+	_, _, notify = l.Allow(1)
+	assert.False(t, notify)
+
+	ok, _, _ = l.Allow(2)
+	assert.True(t, ok)
+
+	ok, scope, _ = l.Allow(3)
+	assert.False(t, ok)
+	assert.Equal(t, rateLimitConnection, scope)
+}
+
+func TestCommandPool_Order(t *testing.T) {
+	p := newCommandPool(CommandsConfig{Concurrency: 3, QueueSize: 10})
+	p.Start()
+
+	var (
+		mutex sync.Mutex
+		res   = map[uint64][]int{}
+	)
+
+	for i := 0; i < 20; i++ {
+		for chatID := uint64(1); chatID <= 4; chatID++ {
+			chatID, i := chatID, i
+			p.Queue(chatID) <- func() {
+				mutex.Lock()
+				defer mutex.Unlock()
+				res[chatID] = append(res[chatID], i)
+			}
+		}
+	}
+
+	p.Stop()
+
+	for chatID, v := range res {
+		assert.Len(t, v, 20)
+		for i := range v {
+			assert.Equal(t, i, v[i], fmt.Sprintf("wrong order in chat %d", chatID))
+		}
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	assert.Equal(t, []string{"short"}, splitMessage("short", 20, "(continued)"))
+
+	lines := make([]string, 30)
+	for k := range lines {
+		lines[k] = fmt.Sprintf("Товар %d", k)
+	}
+	text := strings.Join(lines, "\n")
+
+	parts := splitMessage(text, 100, "(continued)")
+	assert.True(t, len(parts) > 1)
+
+	var res []string
+	for k, p := range parts {
+		assert.True(t, len(p) <= 100)
+		assert.True(t, utf8.ValidString(p))
+		if k < len(parts)-1 {
+			assert.True(t, strings.HasSuffix(p, "\n(continued)"))
+			p = strings.TrimSuffix(p, "\n(continued)")
+		}
+		res = append(res, p)
+	}
+	assert.Equal(t, text, strings.Join(res, "\n"))
+
+	for _, p := range splitMessage(strings.Repeat("ж", 100), 50, "") {
+		assert.True(t, len(p) <= 50)
+		assert.True(t, utf8.ValidString(p))
+	}
+}
+
+func TestOfferPrices(t *testing.T) {
+	vo := v5.Offer{
+		Price: 100,
+		Prices: []v5.OfferPrice{
+			{PriceType: "base", Price: 100},
+			{PriceType: "wholesale", Price: 80},
+		},
+	}
+
+	assert.Equal(t, []v5.OfferPrice{{Price: 100}}, offerPrices(vo, nil))
+	assert.Equal(t, []v5.OfferPrice{{Price: 100}}, offerPrices(vo, []string{"unknown"}))
+	assert.Equal(t,
+		[]v5.OfferPrice{{PriceType: "wholesale", Price: 80}, {PriceType: "base", Price: 100}},
+		offerPrices(vo, []string{"wholesale", "base"}),
+	)
+}
+
+func TestCurrency(t *testing.T) {
+	codes := currencyCodes()
+	assert.Equal(t, "rub", codes["RUB (₽)"])
+	assert.Equal(t, "eur", codes["EUR (€)"])
+
+	assert.Len(t, currencyOptions("rub"), len(currencies))
+	assert.Equal(t, "byr", currencyOptions("byr")["BYR"])
+
+	assert.Equal(t, defaultCurrency, sitesCurrency(nil))
+	assert.Equal(t, "usd", sitesCurrency(map[string]crmSite{
+		"b-shop": {Code: "b-shop", Currency: "EUR"},
+		"a-shop": {Code: "a-shop", Currency: "USD"},
+	}))
+}
+
+func TestAvailableOnSite(t *testing.T) {
+	assert.True(t, availableOnSite(nil, "shop"))
+	assert.True(t, availableOnSite([]string{"shop"}, ""))
+	assert.True(t, availableOnSite([]string{"shop", "shop2"}, "shop2"))
+	assert.False(t, availableOnSite([]string{"shop"}, "shop2"))
+}
+
+func TestConnection_ChannelSites(t *testing.T) {
+	var c Connection
+	assert.Empty(t, c.getChannelSites())
+
+	c.setChannelSites(map[string]string{"1": "shop", "2": ""})
+	assert.Equal(t, map[string]string{"1": "shop"}, c.getChannelSites())
+}
+
+func TestLang(t *testing.T) {
+	assert.Equal(t, "ru", detectLang("где мой заказ"))
+	assert.Equal(t, "es", detectLang("¿dónde está?"))
+	assert.Equal(t, "", detectLang("where is my order"))
+
+	assert.Equal(t, "es", supportedLang("es-MX"))
+	assert.Equal(t, "en", supportedLang("en"))
+	assert.Equal(t, "", supportedLang("zz"))
+}
+
+func TestWorker_chatLocalizer(t *testing.T) {
+	defer gock.Off()
+
+	mgURL := "https://mg.example.com"
+	w := NewWorker(context.Background(), &Connection{
+		ClientID: "lang",
+		APIURL:   crmUrl,
+		MGURL:    mgURL,
+		MGToken:  "token",
+		Lang:     "en",
+	}, sentry, logger)
+
+	gock.New(mgURL).
+		Get("/api/bot/v1/chats").
+		MatchParam("id", "1").
+		Reply(200).
+		BodyString(`[{"id": 1, "customer": {"id": 5, "type": "customer"}}]`)
+	gock.New(mgURL).
+		Get("/api/bot/v1/customers").
+		MatchParam("id", "5").
+		Reply(200).
+		BodyString(`[{"id": 5, "language": "es-MX"}]`)
+
+	message := &v1.Message{
+		ID:     1,
+		ChatID: 1,
+		From:   &v1.UserRef{ID: 7, Type: "user"},
+		Type:   v1.MsgTypeCommand,
+	}
+	message.TextMessage = &v1.TextMessage{Content: "/payment"}
+
+	notFound := getLang("es").MustLocalize(&i18n.LocalizeConfig{MessageID: "not_found"})
+	for i := 0; i < 2; i++ {
+		loc := w.chatLocalizer(message)
+		assert.Equal(t, notFound, loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "not_found"}))
+	}
+	assert.True(t, gock.IsDone())
+
+	// a failed lookup is cached too, the connection language is used meanwhile
+	gock.New(mgURL).
+		Get("/api/bot/v1/chats").
+		MatchParam("id", "2").
+		Reply(500).
+		BodyString(`{"errors": ["internal error"]}`)
+
+	message.ChatID = 2
+	notFound = getLang("en").MustLocalize(&i18n.LocalizeConfig{MessageID: "not_found"})
+	for i := 0; i < 2; i++ {
+		loc := w.chatLocalizer(message)
+		assert.Equal(t, notFound, loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "not_found"}))
+	}
+	assert.True(t, gock.IsDone())
+	assert.False(t, gock.HasUnmatchedRequest())
+
+	w.langs[3] = chatLang{Lang: "es", ExpiresAt: time.Now().Add(-time.Second)}
+	_, ok := w.getChatLang(3)
+	assert.False(t, ok)
+	w.langsSweep = time.Now().Add(-chatLangTTL)
+	w.setChatLang(4, "en", chatLangTTL)
+	assert.NotContains(t, w.langs, uint64(3))
+}
+
+func TestCommandRegistry(t *testing.T) {
+	cmd, line := botCommands.parse("/product red shoes")
+	if assert.NotNil(t, cmd) {
+		assert.Equal(t, CommandProduct, cmd.Name())
+	}
+	assert.Equal(t, []string{"red", "shoes"}, line.Args)
+
+	cmd, line = botCommands.parse("/Заказ 123")
+	if assert.NotNil(t, cmd) {
+		assert.Equal(t, CommandOrder, cmd.Name())
+	}
+	assert.Equal(t, []string{"123"}, line.Args)
+
+	cmd, _ = botCommands.parse("/unknown")
+	assert.Nil(t, cmd)
+
+	credentials := botCommands.credentials(botCommands.names())
+	assert.Contains(t, credentials, "/api/integration-modules/{code}")
+	assert.Contains(t, credentials, "/api/store/products")
+	assert.NotContains(t, credentials, "/api/store/inventories")
+
+	credentials = botCommands.credentials([]string{CommandPayment, CommandHelp})
+	assert.Contains(t, credentials, "/api/reference/payment-types")
+	assert.NotContains(t, credentials, "/api/orders")
+
+	missing := checkCredentials(
+		[]string{"/api/integration-modules/{code}", "/api/integration-modules/{code}/edit", "/api/reference/sites"},
+		credentials,
+	)
+	assert.Equal(t, []string{"/api/reference/payment-types"}, missing)
+
+	seen := map[string]bool{}
+	for _, v := range credentials {
+		assert.False(t, seen[v], v)
+		seen[v] = true
+	}
+
+	assert.Panics(t, func() {
+		newCommandRegistry(paymentCommand{}, paymentCommand{})
+	})
+}
+
+func TestHelpText(t *testing.T) {
+	loc := getLang("en")
+	text := helpText(loc, func(command string) bool {
+		return command != CommandOrder
+	})
+
+	assert.Contains(t, text, CommandProduct+" - "+loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "get_product"}))
+	assert.Contains(t, text, CommandHelp)
+	assert.NotContains(t, text, CommandOrder)
+
+	for _, cmd := range botCommands.all() {
+		assert.NotEmpty(t, loc.MustLocalize(&i18n.LocalizeConfig{MessageID: cmd.Usage()}), cmd.Name())
+	}
+}
+
+func TestParseCommandLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		cmd   string
+		args  []string
+		flags map[string]string
+	}{
+		{"plain text", "hello there", "", nil, map[string]string{}},
+		{"empty", "", "", nil, map[string]string{}},
+		{"command", "/payment", "/payment", nil, map[string]string{}},
+		{"upper case", "/Product Shirt", "/product", []string{"Shirt"}, map[string]string{}},
+		{"mention", "/product@helper_bot shirt", "/product", []string{"shirt"}, map[string]string{}},
+		{"whitespace", " /product \t red  shirt\n", "/product", []string{"red", "shirt"}, map[string]string{}},
+		{"double quotes", `/product "red shirt" xl`, "/product", []string{"red shirt", "xl"}, map[string]string{}},
+		{"single quotes", `/product 'red shirt'`, "/product", []string{"red shirt"}, map[string]string{}},
+		{"apostrophe", `/product Levi's jeans`, "/product", []string{"Levi's", "jeans"}, map[string]string{}},
+		{"escape", `/product "19\" monitor"`, "/product", []string{`19" monitor`}, map[string]string{}},
+		{"unterminated quote", `/product "red shirt`, "/product", []string{"red shirt"}, map[string]string{}},
+		{"empty quotes", `/product ""`, "/product", []string{""}, map[string]string{}},
+		{"flag", `/product --site=shop2 "red shirt"`, "/product", []string{"red shirt"}, map[string]string{"site": "shop2"}},
+		{"flag without value", "/product --All shirt", "/product", []string{"shirt"}, map[string]string{"all": "true"}},
+		{"quoted flag value", `/product --site="my shop" shirt`, "/product", []string{"shirt"}, map[string]string{"site": "my shop"}},
+		{"quoted flag", `/product "--site=shop2"`, "/product", []string{"--site=shop2"}, map[string]string{}},
+		{"end of flags", "/product -- --site=shop2", "/product", []string{"--site=shop2"}, map[string]string{}},
+		{"quoted command", `"/product" shirt`, "", nil, map[string]string{}},
+		{"cyrillic", "/Товар рубашка", "/товар", []string{"рубашка"}, map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := parseCommandLine(tt.text)
+			assert.Equal(t, tt.cmd, line.Name)
+			if tt.cmd != "" {
+				assert.Equal(t, tt.args, line.Args)
+				assert.Equal(t, tt.flags, line.Flags)
+			}
+		})
+	}
+}
+
+func TestCommandRegistry_lookup(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  string
+	}{
+		{"/product", CommandProduct},
+		{"/PRODUCT", CommandProduct},
+		{"/товар", CommandProduct},
+		{"/Pedido", CommandOrder},
+		{"/envío", CommandDelivery},
+		{"/ayuda", CommandHelp},
+		{"/unknown", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, ok := botCommands.lookup(tt.name)
+			assert.Equal(t, tt.cmd != "", ok)
+			if ok {
+				assert.Equal(t, tt.cmd, cmd.Name())
+			}
+		})
+	}
+
+	assert.Panics(t, func() {
+		newCommandRegistry(paymentCommand{}).withAliases(map[language.Tag]map[string]string{
+			language.Russian: {"/заказ": CommandOrder},
+		})
+	})
+}
+
+func TestAutoAnswers(t *testing.T) {
+	answers, err := compileAutoAnswers([]autoAnswerRule{
+		{Keywords: "delivery, shipping", Reply: "/delivery"},
+		{Keywords: `price of (\w+)`, Regexp: true, Reply: "/product {{index .Match 1}}"},
+		{Keywords: "hello", Reply: "Hello, {{.Name}}!"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	a, match := matchAutoAnswer(answers, "How much is Shipping?")
+	if assert.NotNil(t, a) {
+		assert.True(t, a.command)
+		assert.Equal(t, []string{"shipping"}, match)
+	}
+
+	a, match = matchAutoAnswer(answers, "what is the PRICE OF shoes")
+	if assert.NotNil(t, a) {
+		assert.True(t, a.command)
+		assert.Equal(t, []string{"PRICE OF shoes", "shoes"}, match)
+
+		var buf strings.Builder
+		assert.NoError(t, a.reply.Execute(&buf, autoAnswerData{Match: match}))
+		assert.Equal(t, "/product shoes", buf.String())
+	}
+
+	a, _ = matchAutoAnswer(answers, "hello there")
+	if assert.NotNil(t, a) && assert.False(t, a.command) {
+		var buf strings.Builder
+		assert.NoError(t, a.reply.Execute(&buf, autoAnswerData{Name: "Ann"}))
+		assert.Equal(t, "Hello, Ann!", buf.String())
+	}
+
+	a, _ = matchAutoAnswer(answers, "thanks")
+	assert.Nil(t, a)
+
+	invalid := []autoAnswerRule{
+		{Keywords: " ", Reply: "text"},
+		{Keywords: "a", Reply: ""},
+		{Keywords: "(", Regexp: true, Reply: "text"},
+		{Keywords: "a", Reply: "/unknown"},
+		{Keywords: "a", Reply: "/order 123"},
+		{Keywords: "a", Reply: "/Заказ {{.Text}}"},
+		{Keywords: "a", Reply: "{{.Name"},
+	}
+	for _, v := range invalid {
+		_, err := v.compile()
+		assert.Error(t, err, v)
+	}
+}
+
+func TestConnection_Commands(t *testing.T) {
+	c := Connection{}
+	assert.Equal(t, botCommands.names(), c.getCommands())
+
+	c.setCommands([]string{CommandHelp, "/unknown", CommandPayment})
+	assert.Equal(t, []string{CommandPayment, CommandHelp}, c.getCommands())
+	assert.True(t, c.isCommandEnabled(CommandPayment))
+	assert.False(t, c.isCommandEnabled(CommandOrder))
+
+	c.setCommands(nil)
+	assert.Empty(t, c.getCommands())
+}
+
+func TestWorker_execCommandDisabled(t *testing.T) {
+	defer gock.Off()
+
+	conn := &Connection{ClientID: "disabled", APIURL: crmUrl}
+	conn.setCommands([]string{CommandPayment})
+	w := NewWorker(context.Background(), conn, sentry, logger)
+
+	gock.New(crmUrl).
+		Get("/api/v5/orders").
+		Reply(200).
+		BodyString(`{"success": true, "orders": []}`)
+
+	loc := getLang("en")
+	res, _, err := w.execCommand(loc, 1, "/order 1234A")
+	assert.NoError(t, err)
+	assert.Equal(t, loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "command_disabled"}), res)
+	assert.True(t, gock.IsPending())
+}
+
+func TestConnection_AutoAnswers(t *testing.T) {
+	c := Connection{}
+	assert.Empty(t, c.getAutoAnswers().Rules)
+
+	answers := autoAnswers{
+		Rules:          []autoAnswerRule{{Keywords: "delivery", Reply: "/delivery"}},
+		UnassignedOnly: true,
+	}
+	c.setAutoAnswers(answers)
+	assert.Equal(t, answers, c.getAutoAnswers())
+
+	c.setAutoAnswers(autoAnswers{Rules: []autoAnswerRule{
+		{Keywords: "order", Reply: "/order 1"},
+		{Keywords: "delivery", Reply: "/delivery"},
+	}})
+	assert.Len(t, connectionAnswers(&c), 1)
+}
+
+func TestWorker_replyAutoAnswerErrors(t *testing.T) {
+	defer gock.Off()
+
+	mgURL := "https://mg.example.com"
+	conn := &Connection{
+		ClientID: "answers",
+		APIURL:   crmUrl,
+		MGURL:    mgURL,
+		MGToken:  "token",
+		Lang:     "en",
+	}
+	conn.setCommands([]string{CommandDelivery})
+	conn.setAutoAnswers(autoAnswers{Rules: []autoAnswerRule{
+		{Keywords: "delivery", Reply: "/delivery"},
+		{Keywords: "payment", Reply: "/payment"},
+	}})
+	w := NewWorker(context.Background(), conn, sentry, logger)
+	w.setChatLang(1, "en", chatLangTTL)
+
+	gock.New(crmUrl).
+		Get("/api/v5/reference/delivery-types").
+		Reply(500).
+		BodyString(`{"success": false, "errorMsg": "Internal error"}`)
+	gock.New(mgURL).
+		Post("/api/bot/v1/messages").
+		Reply(200).
+		BodyString(`{"message_id": 1}`)
+
+	for _, v := range []string{"delivery please", "payment please"} {
+		message := &v1.Message{
+			ID:     1,
+			ChatID: 1,
+			From:   &v1.UserRef{ID: 5, Type: "customer"},
+			Type:   v1.MsgTypeText,
+		}
+		message.TextMessage = &v1.TextMessage{Content: v}
+		w.replyAutoAnswer(message)
+	}
+
+	// the CRM error is not sent to the customer and the disabled command is not run
+	if pending := gock.Pending(); assert.Len(t, pending, 1) {
+		assert.Equal(t, "/api/bot/v1/messages", pending[0].Request().URLStruct.Path)
+	}
+	assert.False(t, gock.HasUnmatchedRequest())
+}
+
+func TestEventSettings(t *testing.T) {
+	assert.NoError(t, eventSettings{Greeting: "Hello, {{.Name}}!", Farewell: "Bye"}.validate())
+	assert.Error(t, eventSettings{Greeting: "Hello, {{.Name"}.validate())
+
+	msg, err := executeEventTemplate("Hello, {{.Name}}!", &v1.Chat{Customer: &v1.UserRef{Name: "Ann"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello, Ann!", msg)
+
+	msg, err = executeEventTemplate("Hello{{if .Name}}, {{.Name}}{{end}}!", &v1.Chat{})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello!", msg)
+
+	assert.Contains(t, getLang("en").MustLocalize(&i18n.LocalizeConfig{MessageID: "greeting"}), "{{.Name}}")
+
+	c := Connection{}
+	settings := eventSettings{Greeting: "Hello", RerunEdited: true}
+	c.setEventSettings(settings)
+	assert.Equal(t, settings, c.getEventSettings())
+}
+
+func TestWorker_dialogEvents(t *testing.T) {
+	w := NewWorker(context.Background(), &Connection{ClientID: "events", APIURL: crmUrl}, sentry, logger)
+
+	_, ok := w.getChatDialog(1)
+	assert.False(t, ok)
+
+	w.handleDialogAssign(v1.WsEventDialogAssignData{
+		Dialog: &v1.Dialog{ID: 10, Responsible: &v1.Responsible{ID: 5, Type: "user"}},
+		Chat:   &v1.Chat{ID: 1},
+	})
+	assigned, err := w.chatAssigned(1)
+	assert.NoError(t, err)
+	assert.True(t, assigned)
+
+	w.handleDialogClosed(&v1.Dialog{ID: 10, Chat: &v1.Chat{ID: 1}})
+	assigned, err = w.chatAssigned(1)
+	assert.NoError(t, err)
+	assert.False(t, assigned)
+
+	expired := time.Now().Add(-chatDialogTTL - time.Second)
+	w.dialogs[4] = chatDialog{Assigned: true, UpdatedAt: expired}
+	_, ok = w.getChatDialog(4)
+	assert.False(t, ok)
+	w.setChatDialog(1, func(d *chatDialog) {})
+	assert.Contains(t, w.dialogs, uint64(4))
+	w.dialogsSweep = expired
+	w.setChatDialog(1, func(d *chatDialog) {})
+	assert.NotContains(t, w.dialogs, uint64(4))
+
+	w.handleChatCreated(&v1.Chat{ID: 2, Channel: &v1.Channel{ID: 7}})
+	assert.Empty(t, w.channels)
+
+	conn := *w.getConnection()
+	conn.setChannelSites(map[string]string{"7": "shop"})
+	w.UpdateWorker(&conn)
+
+	w.handleChatCreated(&v1.Chat{ID: 2, Channel: &v1.Channel{ID: 7}})
+	channelID, err := w.chatChannel(2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), channelID)
+	assert.Equal(t, "shop", w.chatSite(2))
+
+	w.channels[5] = chatChannel{ID: 7, CreatedAt: expired}
+	w.setChatChannel(6, 7)
+	assert.Contains(t, w.channels, uint64(5))
+	w.channelsSweep = expired
+	w.setChatChannel(6, 7)
+	assert.NotContains(t, w.channels, uint64(5))
+
+	assert.True(t, w.setEditedContent(3, "/order 1"))
+	assert.False(t, w.setEditedContent(3, "/order 1"))
+	assert.True(t, w.setEditedContent(3, "/order 2"))
+}
+
+func TestWorker_siteOptions(t *testing.T) {
+	defer gock.Off()
+
+	conn := &Connection{ClientID: "site-options", APIURL: crmUrl, Lang: "en"}
+	conn.setChannelSites(map[string]string{"7": "shop"})
+	w := NewWorker(context.Background(), conn, sentry, logger)
+	w.setChatChannel(1, 7)
+
+	gock.New(crmUrl).
+		Get("/api/v5/reference/payment-types").
+		Reply(200).
+		BodyString(`{"success": true, "paymentTypes": {
+			"cash": {"code": "cash", "name": "Cash", "active": true, "sites": ["shop"]},
+			"card": {"code": "card", "name": "Card", "active": true, "sites": ["outlet"]},
+			"bank": {"code": "bank", "name": "Bank transfer", "active": true}
+		}}`)
+	gock.New(crmUrl).
+		Get("/api/v5/reference/delivery-types").
+		Reply(200).
+		BodyString(`{"success": true, "deliveryTypes": {
+			"courier": {"code": "courier", "name": "Courier", "active": true, "sites": ["outlet"]},
+			"pickup": {"code": "pickup", "name": "Pickup", "active": true, "sites": ["shop", "outlet"]}
+		}}`)
+
+	loc := getLang("en")
+	res, _, err := w.execCommand(loc, 1, "/payment")
+	assert.NoError(t, err)
+	assert.Contains(t, res, "Cash")
+	assert.Contains(t, res, "Bank transfer")
+	assert.NotContains(t, res, "Card")
+
+	res, _, err = w.execCommand(loc, 1, "/delivery")
+	assert.NoError(t, err)
+	assert.Contains(t, res, "Pickup")
+	assert.NotContains(t, res, "Courier")
+
+	assert.True(t, gock.IsDone())
+}
+
+func TestWorker_handleCommandRateLimit(t *testing.T) {
+	defer gock.Off()
+
+	mgURL := "https://mg.example.com"
+	conn := &Connection{
+		ClientID: "limited",
+		APIURL:   crmUrl,
+		MGURL:    mgURL,
+		MGToken:  "token",
+		Lang:     "en",
+	}
+	conn.setCommands([]string{CommandPayment})
+	w := NewWorker(context.Background(), conn, sentry, logger)
+	w.limiter = newRateLimiter(RateLimitConfig{ChatRate: 1, ChatBurst: 1})
+	w.setChatLang(1, "en", chatLangTTL)
+	w.pool.Start()
+	defer w.pool.Stop()
+
+	// only the first command runs, a second payment reply would be an unmatched request
+	gock.New(crmUrl).
+		Get("/api/v5/reference/payment-types").
+		Reply(200).
+		BodyString(`{"success": true, "paymentTypes": {"cash": {"code": "cash", "name": "Cash", "active": true}}}`)
+	limit := getLang("en").MustLocalize(&i18n.LocalizeConfig{MessageID: "too_many_requests"})
+	for _, v := range []string{"Cash", limit} {
+		gock.New(mgURL).
+			Post("/api/bot/v1/messages").
+			BodyString(v).
+			Reply(200).
+			BodyString(`{"message_id": 1}`)
+	}
+
+	// the third command is rejected silently, the chat was already notified
+	for i := 0; i < 3; i++ {
+		message := &v1.Message{ID: uint64(i), ChatID: 1, From: &v1.UserRef{ID: 7, Type: "user"}, Type: v1.MsgTypeCommand}
+		message.TextMessage = &v1.TextMessage{Content: "/payment"}
+		w.handleCommand(message)
+	}
+
+	done := make(chan struct{})
+	w.enqueue(1, func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("replies were not sent")
+	}
+
+	assert.True(t, gock.IsDone())
+	assert.False(t, gock.HasUnmatchedRequest())
+}
+
+func TestWorker_handleCommandQueueFull(t *testing.T) {
+	defer gock.Off()
+
+	mgURL := "https://mg.example.com"
+	w := NewWorker(context.Background(), &Connection{
+		ClientID: "busy",
+		APIURL:   crmUrl,
+		MGURL:    mgURL,
+		MGToken:  "token",
+		Lang:     "en",
+	}, sentry, logger)
+	w.pool = newCommandPool(CommandsConfig{Concurrency: 1, QueueSize: 1})
+	w.setChatLang(1, "en", chatLangTTL)
+
+	busy := getLang("en").MustLocalize(&i18n.LocalizeConfig{MessageID: "commands_busy"})
+	gock.New(mgURL).
+		Post("/api/bot/v1/messages").
+		BodyString(busy).
+		Reply(200).
+		BodyString(`{"message_id": 1}`)
+
+	// the pool is not started, so queued tasks are never taken
+	for w.enqueue(1, func() {}) {
+	}
+
+	handled := make(chan struct{})
+	go func() {
+		message := &v1.Message{ID: 1, ChatID: 1, From: &v1.UserRef{ID: 7, Type: "user"}, Type: v1.MsgTypeCommand}
+		message.TextMessage = &v1.TextMessage{Content: "/help"}
+		w.handleCommand(message)
+		close(handled)
+	}()
+
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("handleCommand blocked on the full queue")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for gock.IsPending() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, gock.IsDone())
+}
+
+func TestWorker_dialogMessages(t *testing.T) {
+	defer gock.Off()
+
+	mgURL := "https://mg.example.com"
+	conn := &Connection{
+		ClientID: "messages",
+		APIURL:   crmUrl,
+		MGURL:    mgURL,
+		MGToken:  "token",
+		Lang:     "en",
+	}
+	conn.setCommands([]string{CommandHelp})
+	conn.setEventSettings(eventSettings{Greeting: "Hello, {{.Name}}!", Farewell: "Bye", RerunEdited: true})
+
+	w := NewWorker(context.Background(), conn, sentry, logger)
+	w.setChatLang(1, "en", chatLangTTL)
+	w.pool.Start()
+	defer w.pool.Stop()
+
+	for _, v := range []string{"Hello, Ann!", "Bye", `"scope":"private"`} {
+		gock.New(mgURL).
+			Post("/api/bot/v1/messages").
+			BodyString(v).
+			Reply(200).
+			BodyString(`{"message_id": 1}`)
+	}
+
+	chat := &v1.Chat{ID: 1, Customer: &v1.UserRef{Name: "Ann"}}
+	w.handleDialogOpened(&v1.Dialog{ID: 1, Chat: chat})
+	w.handleDialogClosed(&v1.Dialog{ID: 1, Chat: chat})
+
+	// the edit and the following status updates carry the same content
+	for i := 0; i < 3; i++ {
+		message := &v1.Message{
+			ID:     2,
+			ChatID: 1,
+			IsEdit: true,
+			From:   &v1.UserRef{ID: 7, Type: "user"},
+			Type:   v1.MsgTypeCommand,
+		}
+		message.TextMessage = &v1.TextMessage{Content: "/help"}
+		w.handleMessageUpdated(message)
+	}
+
+	// tasks of a chat run in order, so the last one runs after the replies are sent
+	done := make(chan struct{})
+	w.enqueue(1, func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("replies were not sent")
+	}
+
+	assert.True(t, gock.IsDone())
+	assert.False(t, gock.HasUnmatchedRequest())
+}
+
+func TestReplyTemplates(t *testing.T) {
+	for _, v := range replyTemplates {
+		_, err := previewReplyTemplate(v.Name, "{{.}}")
+		assert.NoError(t, err, v.Name)
+	}
+
+	res, err := previewReplyTemplate(replyPayment, "{{range $i, $v := .Items}}{{number (inc $i)}} {{$v}}\n{{end}}")
+	assert.NoError(t, err)
+	assert.Equal(t, "1️⃣ Cash\n2️⃣ Bank card\n", res)
+
+	_, err = previewReplyTemplate(replyPayment, "{{unknown .Items}}")
+	assert.Error(t, err)
+
+	res, err = previewReplyTemplate(replyPayment, `{{join .Items ", "}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "Cash, Bank card", res)
+
+	res, err = previewReplyTemplate(replyOrder, "{{.Number}}: {{.Status}}, {{.Total}} {{.Currency}}")
+	assert.NoError(t, err)
+	assert.Equal(t, "1234A: New, 1500 rub", res)
+
+	res, err = previewReplyTemplate(replyProduct, "{{range .Items}}{{.Name}}{{range .Stock}} {{.Store}}: {{.Quantity}}{{end}}{{end}}")
+	assert.NoError(t, err)
+	assert.Equal(t, "T-shirt, red, M Main store: 12", res)
+
+	doubling := `{{define "a"}}xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx{{end}}` +
+		`{{define "b"}}{{template "a"}}{{template "a"}}{{template "a"}}{{template "a"}}{{end}}` +
+		`{{define "c"}}{{template "b"}}{{template "b"}}{{template "b"}}{{template "b"}}{{end}}` +
+		`{{define "d"}}{{template "c"}}{{template "c"}}{{template "c"}}{{template "c"}}{{end}}` +
+		`{{template "d"}}{{template "d"}}{{template "d"}}{{template "d"}}`
+	_, err = previewReplyTemplate(replyPayment, doubling)
+	assert.Error(t, err)
+
+	_, err = previewReplyTemplate(replyPayment, `{{printf "%*d" 100000000 1}}`)
+	assert.Error(t, err)
+	_, err = previewReplyTemplate(replyPayment, `{{printf "%100000000d" 1}}`)
+	assert.Error(t, err)
+
+	res, err = previewReplyTemplate(replyPayment, `{{printf "%5.2f" 1.5}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, " 1.50", res)
+
+	_, err = executeEventTemplate(doubling, &v1.Chat{})
+	assert.Error(t, err)
+
+	answer, err := autoAnswerRule{Keywords: "a", Reply: doubling}.compile()
+	if assert.NoError(t, err) {
+		_, err = executeTemplate(answer.reply, autoAnswerData{})
+		assert.Error(t, err)
+	}
+
+	assert.Equal(t, "1️⃣ 2️⃣", numberEmoji(12))
+
+	assert.NoError(t, validateReplyTemplates(map[string]string{replyOrder: "{{.Number}}", replyPayment: ""}))
+	assert.Error(t, validateReplyTemplates(map[string]string{replyOrder: "{{.Unknown}}"}))
+	assert.Error(t, validateReplyTemplates(map[string]string{"unknown": "text"}))
+
+	c := Connection{}
+	c.setReplyTemplates(map[string]string{replyOrder: "{{.Number}}", replyPayment: " ", "unknown": "text"})
+	assert.Equal(t, map[string]string{replyOrder: "{{.Number}}"}, c.getReplyTemplates())
+}
+
+func TestWorker_orderInfo(t *testing.T) {
+	defer gock.Off()
+
+	w := NewWorker(context.Background(), &Connection{
+		ClientID: "order",
+		APIURL:   crmUrl,
+		APIKEY:   "key",
+		Currency: "rub",
+	}, sentry, logger)
+	loc := getLang("en")
+
+	gock.New(crmUrl).
+		Get("/api/v5/orders").
+		MatchParam("filter[numbers][]", "0000").
+		Reply(200).
+		BodyString(`{"success": true, "orders": []}`)
+
+	res, err := w.orderInfo(loc, "0000")
+	assert.NoError(t, err)
+	assert.Equal(t, loc.MustLocalize(&i18n.LocalizeConfig{MessageID: "not_found"}), res)
+
+	gock.New(crmUrl).
+		Get("/api/v5/orders").
+		MatchParam("filter[numbers][]", "1234A").
+		Reply(200).
+		BodyString(`{"success": true, "orders": [{"number": "1234A", "status": "new", "delivery": {"code": "courier"}, "payments": [{"status": "paid"}], "totalSumm": 1500}]}`)
+	gock.New(crmUrl).
+		Get("/api/v5/reference/statuses").
+		Reply(200).
+		BodyString(`{"success": true, "statuses": {"new": {"code": "new", "name": "New"}}}`)
+	gock.New(crmUrl).
+		Get("/api/v5/reference/delivery-types").
+		Reply(200).
+		BodyString(`{"success": true, "deliveryTypes": {"courier": {"code": "courier", "name": "Courier"}}}`)
+	gock.New(crmUrl).
+		Get("/api/v5/reference/payment-statuses").
+		Reply(200).
+		BodyString(`{"success": true, "paymentStatuses": {"paid": {"code": "paid", "name": "Paid"}}}`)
+
+	res, err = w.orderInfo(loc, "1234A")
+	assert.NoError(t, err)
+	assert.Equal(t, "Order: 1234A\nStatus: New\nDelivery: Courier\nPayment: Paid\nTotal: 1500 rub", res)
+	assert.True(t, gock.IsDone())
+}
+
+func TestWorker_productSearchSweep(t *testing.T) {
+	w := NewWorker(context.Background(), &Connection{ClientID: "searches", APIURL: crmUrl}, sentry, logger)
+
+	w.setProductSearch(2, &productSearch{Query: "shirts", CreatedAt: time.Now()})
+
+	expired := time.Now().Add(-productSearchTTL - time.Second)
+	w.searches[1] = &productSearch{Query: "shoes", CreatedAt: expired}
+	assert.Nil(t, w.getProductSearch(1))
+
+	// the sweep runs once per TTL, not on every search
+	w.setProductSearch(2, &productSearch{Query: "shirts", CreatedAt: time.Now()})
+	assert.Contains(t, w.searches, uint64(1))
+
+	w.searchesSweep = expired
+	w.setProductSearch(2, &productSearch{Query: "shirts", CreatedAt: time.Now()})
+	assert.NotContains(t, w.searches, uint64(1))
+	assert.NotNil(t, w.getProductSearch(2))
+}
+
+func TestWorker_productCommand(t *testing.T) {
+	defer gock.Off()
+
+	w := NewWorker(context.Background(), &Connection{
+		ClientID: "product",
+		APIURL:   crmUrl,
+		APIKEY:   "key",
+		Currency: "rub",
+	}, sentry, logger)
+	loc := getLang("en")
+	localize := func(id string) string {
+		return loc.MustLocalize(&i18n.LocalizeConfig{MessageID: id})
+	}
+
+	res, _, err := w.productCommand(loc, 1, "next", "")
+	assert.NoError(t, err)
+	assert.Equal(t, localize("set_name_or_article"), res)
+
+	gock.New(crmUrl).
+		Get("/api/v5/store/products").
+		MatchParam("filter[name]", "shirt").
+		MatchParam("page", "1").
+		Reply(200).
+		BodyString(`{"success": true, "pagination": {"currentPage": 1, "totalPageCount": 2}, "products": [
+			{"id": 1, "name": "T-shirt", "article": "TS", "offers": [{"id": 11, "name": "T-shirt", "price": 990}]},
+			{"id": 2, "name": "Sweatshirt", "offers": [{"id": 21, "name": "Sweatshirt", "price": 1990}]}
+		]}`)
+
+	res, _, err = w.productCommand(loc, 1, "shirt", "")
+	assert.NoError(t, err)
+	assert.Contains(t, res, "Found products (page 1 of 2):")
+	assert.Contains(t, res, "1️⃣  T-shirt (TS)")
+	assert.Contains(t, res, "2️⃣  Sweatshirt")
+	assert.Contains(t, res, localize("product_next"))
+
+	gock.New(crmUrl).
+		Get("/api/v5/store/products").
+		MatchParam("filter[name]", "shirt").
+		MatchParam("page", "2").
+		Reply(200).
+		BodyString(`{"success": true, "pagination": {"currentPage": 2, "totalPageCount": 2}, "products": [
+			{"id": 3, "name": "Shirt", "article": "SH", "offers": [{"id": 31, "name": "Shirt", "article": "SH", "price": 1500}]}
+		]}`)
+
+	res, _, err = w.productCommand(loc, 1, "NEXT", "")
+	assert.NoError(t, err)
+	assert.Contains(t, res, "Found products (page 2 of 2):")
+	assert.Contains(t, res, "1️⃣  Shirt (SH)")
+	assert.NotContains(t, res, localize("product_next"))
+	assert.True(t, gock.IsDone())
+
+	res, _, err = w.productCommand(loc, 1, "next", "")
+	assert.NoError(t, err)
+	assert.Equal(t, localize("no_more_products"), res)
+
+	res, prod, err := w.productCommand(loc, 1, "#1", "")
+	assert.NoError(t, err)
+	assert.Empty(t, res)
+	assert.Equal(t, uint64(31), prod.ID)
+	assert.Equal(t, "Shirt", prod.Name)
+	assert.Equal(t, float32(1500), prod.Cost.Value)
+	assert.Equal(t, "rub", prod.Cost.Currency)
+
+	for _, v := range []string{"#0", "#2"} {
+		res, prod, err = w.productCommand(loc, 1, v, "")
+		assert.NoError(t, err, v)
+		assert.Equal(t, localize("product_not_selected"), res, v)
+		assert.Zero(t, prod.ID, v)
+	}
+
+	res, _, err = w.productCommand(loc, 2, "#1", "")
+	assert.NoError(t, err)
+	assert.Equal(t, localize("product_not_selected"), res)
+}
+
+func TestWorker_productReplyStock(t *testing.T) {
+	defer gock.Off()
+
+	w := NewWorker(context.Background(), &Connection{
+		ClientID:  "stock",
+		APIURL:    crmUrl,
+		APIKEY:    "key",
+		Currency:  "rub",
+		ShowStock: true,
+	}, sentry, logger)
+	loc := getLang("en")
+
+	gock.New(crmUrl).
+		Get("/api/v5/store/inventories").
+		MatchParam("filter[details]", "1").
+		Reply(200).
+		BodyString(`{"success": true, "offers": [
+			{"id": 11, "stores": [{"store": "main", "quantity": 2}, {"store": "outlet", "quantity": 1}]},
+			{"id": 12, "stores": []}
+		]}`)
+	gock.New(crmUrl).
+		Get("/api/v5/reference/stores").
+		Reply(200).
+		BodyString(`{"success": true, "stores": [{"code": "main", "name": "Main store"}]}`)
+
+	product := v5.Product{ID: 1, Name: "T-shirt", Offers: []v5.Offer{
+		{ID: 11, Name: "T-shirt S", Article: "TS-S", Price: 990, Quantity: 3, Unit: &v5.Unit{Sym: "pcs"}},
+		{ID: 12, Name: "T-shirt M", Article: "TS-M", Price: 990},
+	}}
+
+	res, prod, err := w.productReply(loc, product, "TS-M", "")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(12), prod.ID)
+	assert.Equal(
+		t,
+		"Product variants:\n\n"+
+			"1️⃣  T-shirt S (TS-S) — 990 rub — 3 pcs\n"+
+			"    Main store: 2 pcs\n"+
+			"    outlet: 1 pcs\n"+
+			"2️⃣  T-shirt M (TS-M) — 990 rub — 0",
+		res,
+	)
+	assert.True(t, gock.IsDone())
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	httpRequestDuration.Reset()
+
+	r := gin.New()
+	r.Use(metricsMiddleware(r))
+	r.GET("/static/*filepath", func(c *gin.Context) {
+		c.Status(http.StatusNotFound)
+	})
+	r.GET("/settings/:uid", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	for _, v := range []string{"/static/a1", "/static/a2", "/settings/1", "/settings/2", "/unknown1", "/unknown2"} {
+		req, _ := http.NewRequest("GET", v, nil)
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	httpRequestDuration.Collect(ch)
+	close(ch)
+	assert.Len(t, ch, 3)
+
+	assert.True(t, httpRequestDuration.DeleteLabelValues("GET", "/static/*filepath", "404"))
+	assert.True(t, httpRequestDuration.DeleteLabelValues("GET", "/settings/:uid", "200"))
+	assert.True(t, httpRequestDuration.DeleteLabelValues("other", "unmatched", "404"))
+}
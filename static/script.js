@@ -26,7 +26,37 @@ $("#but-settings").on("click", function(e) {
         {
             client_id: $(this).attr('data-clientID'),
             lang: $("select#lang").find(":selected").text(),
-            currency: $("select#currency").find(":selected").val()
+            currency: $("select#currency").find(":selected").val(),
+            commands: $("input.command:checked").map(function() {
+                return $(this).val();
+            }).get(),
+            show_stock: $("input#show_stock").is(":checked"),
+            price_types: $(".price-types-select").length ? $("input.price-type:checked").map(function() {
+                return $(this).val();
+            }).get() : null,
+            channel_sites: $(".channels-select").length ? $("select.channel-site").toArray().reduce(function(sites, el) {
+                sites[$(el).attr('data-channel')] = $(el).val();
+                return sites;
+            }, {}) : null,
+            auto_answers: {
+                rules: $("#auto-answer-rules .auto-answer").map(function() {
+                    return {
+                        keywords: $(this).find("input.auto-answer-keywords").val(),
+                        regexp: $(this).find("input.auto-answer-regexp").is(":checked"),
+                        reply: $(this).find("textarea.auto-answer-reply").val()
+                    };
+                }).get(),
+                unassigned_only: $("input#auto_answers_unassigned").is(":checked")
+            },
+            events: {
+                greeting: $("textarea#greeting").val(),
+                farewell: $("textarea#farewell").val(),
+                rerun_edited: $("input#rerun_edited").is(":checked")
+            },
+            replies: $("textarea.reply").toArray().reduce(function(replies, el) {
+                replies[$(el).attr('data-reply')] = $(el).val();
+                return replies;
+            }, {})
         },
         function (data) {
             M.toast({
@@ -41,6 +71,50 @@ $("#but-settings").on("click", function(e) {
     )
 });
 
+$("#auto-answer-add").on("click", function(e) {
+    e.preventDefault();
+    $("#auto-answer-rules").append($("#auto-answer-template").html());
+});
+
+$(document).on("click", ".auto-answer-remove", function(e) {
+    e.preventDefault();
+    $(this).closest(".auto-answer").remove();
+});
+
+$("textarea.reply").on("input", function() {
+    let el = $(this);
+    clearTimeout(el.data('timer'));
+    el.data('timer', setTimeout(function() {
+        previewReply(el);
+    }, 300));
+});
+
+function previewReply(el) {
+    let preview = el.closest(".reply-template").find(".reply-preview");
+    if (el.val() === "") {
+        preview.text("").removeClass("error");
+        return;
+    }
+
+    $.ajax({
+        url: "/reply-preview/",
+        data: JSON.stringify({
+            client_id: $("#but-settings").attr('data-clientID'),
+            name: el.attr('data-reply'),
+            template: el.val()
+        }),
+        type: "POST",
+        success: function (data) {
+            preview.text(data.preview).removeClass("error");
+        },
+        error: function (res) {
+            if (res.responseJSON) {
+                preview.text(res.responseJSON.error).addClass("error");
+            }
+        }
+    });
+}
+
 $("#save").on("submit", function(e) {
     e.preventDefault();
     let formData = formDataToObj($(this).serializeArray());
@@ -97,6 +171,9 @@ function formDataToObj(formArray) {
 $( document ).ready(function() {
     $('select').formSelect();
     M.Tabs.init(document.getElementById("tab"));
+    $("textarea.reply").each(function() {
+        previewReply($(this));
+    });
 
     let createdMsg = sessionStorage.getItem("createdMsg");
     if (createdMsg) {